@@ -0,0 +1,365 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api/v1"
+	servicehelper "k8s.io/kubernetes/pkg/api/v1/service"
+)
+
+const (
+	serviceSchedulerAnnotationKey              = "k8s.co/keepalived-scheduler"
+	servicePersistenceTimeoutAnnotationKey     = "k8s.co/keepalived-persistence-timeout"
+	servicePersistenceGranularityAnnotationKey = "k8s.co/keepalived-persistence-granularity"
+
+	serviceProxyProtocolAnnotationKey = "k8s.co/keepalived-proxy-protocol"
+	serviceSNIHostnamesAnnotationKey  = "k8s.co/keepalived-sni-hostnames"
+
+	serviceHealthCheckAnnotationKey         = "k8s.co/keepalived-health-check"
+	serviceHealthCheckPathAnnotationKey     = "k8s.co/keepalived-health-check-path"
+	serviceHealthCheckStatusAnnotationKey   = "k8s.co/keepalived-health-check-status"
+	serviceHealthCheckIntervalAnnotationKey = "k8s.co/keepalived-health-check-interval"
+	serviceHealthCheckRetriesAnnotationKey  = "k8s.co/keepalived-health-check-retries"
+)
+
+// defaultClientIPAffinityTimeout is the persistence timeout used for services
+// with sessionAffinity: ClientIP that do not set one explicitly. It matches
+// the default used by kube-proxy.
+const defaultClientIPAffinityTimeout = 10800
+
+// validForwardMethods are the IPVS forwarding methods accepted by
+// kube-keepalived-vip and keepalived's lb_kind setting.
+var validForwardMethods = map[string]bool{
+	"NAT": true,
+	"DR":  true,
+}
+
+// forwardMethodProxy is the method of kube-keepalived-vip entries that are
+// forwarded by haproxy with the PROXY protocol.
+const forwardMethodProxy = "PROXY"
+
+const (
+	proxyProtocolV1 = "v1"
+	proxyProtocolV2 = "v2"
+)
+
+// vipUnsupportedAnnotations configure options that cannot be expressed in a
+// kube-keepalived-vip ConfigMap entry, which is only namespace/name[:method].
+var vipUnsupportedAnnotations = []string{
+	serviceHealthCheckAnnotationKey,
+	serviceHealthCheckPathAnnotationKey,
+	serviceHealthCheckStatusAnnotationKey,
+	serviceHealthCheckIntervalAnnotationKey,
+	serviceHealthCheckRetriesAnnotationKey,
+}
+
+// vipUnappliedAnnotations configure IPVS settings that a kube-keepalived-vip
+// ConfigMap entry cannot carry either. They are still validated and recorded
+// in the config, so that they take effect if the config format is changed,
+// but kube-keepalived-vip applies its own scheduler and persistence.
+var vipUnappliedAnnotations = []string{
+	serviceSchedulerAnnotationKey,
+	servicePersistenceTimeoutAnnotationKey,
+	servicePersistenceGranularityAnnotationKey,
+}
+
+// validSchedulers are the IPVS scheduling algorithms accepted by keepalived's
+// lb_algo setting.
+var validSchedulers = map[string]bool{
+	"rr":   true,
+	"wrr":  true,
+	"lc":   true,
+	"wlc":  true,
+	"lblc": true,
+	"sh":   true,
+	"mh":   true,
+	"dh":   true,
+	"sed":  true,
+	"nq":   true,
+}
+
+// validProtocols are the service port protocols that can be load balanced by
+// IPVS.
+var validProtocols = map[v1.Protocol]bool{
+	v1.ProtocolTCP: true,
+	v1.ProtocolUDP: true,
+}
+
+// unappliedAnnotations returns the annotations of service that are accepted,
+// but not applied, in the provider's config format.
+func (k *KeepalivedLoadBalancer) unappliedAnnotations(service *v1.Service) []string {
+	if k.configFormat != configFormatVIP {
+		return nil
+	}
+	var unapplied []string
+	for _, a := range vipUnappliedAnnotations {
+		if _, ok := service.Annotations[a]; ok {
+			unapplied = append(unapplied, a)
+		}
+	}
+	return unapplied
+}
+
+// serviceConfigFor builds the desired serviceConfig for service, without an
+// IP, from the service spec, its annotations and the provider defaults.
+func (k *KeepalivedLoadBalancer) serviceConfigFor(service *v1.Service) (serviceConfig, error) {
+	sc := serviceConfig{
+		UID:              string(service.UID),
+		ServiceNamespace: service.Namespace,
+		ServiceName:      service.Name,
+		ForwardMethod:    k.forwardMethod,
+	}
+
+	if k.configFormat == configFormatVIP {
+		for _, a := range vipUnsupportedAnnotations {
+			if _, ok := service.Annotations[a]; ok {
+				return sc, fmt.Errorf("annotation %s is not supported by %s, set KEEPALIVED_CONFIG_FORMAT to %s to use it", a, configFormatVIP, configFormatKeepalived)
+			}
+		}
+	}
+
+	if fm, ok := service.Annotations[serviceForwardMethodAnnotationKey]; ok {
+		if !validForwardMethods[fm] {
+			return sc, fmt.Errorf("invalid forward method '%s' in annotation %s", fm, serviceForwardMethodAnnotationKey)
+		}
+		sc.ForwardMethod = fm
+	}
+
+	if p, ok := service.Annotations[servicePoolAnnotationKey]; ok {
+		if _, ok := k.poolByName(p); !ok {
+			return sc, fmt.Errorf("unknown pool '%s' in annotation %s", p, servicePoolAnnotationKey)
+		}
+		sc.Pool = p
+	}
+
+	if pp, ok := service.Annotations[serviceProxyProtocolAnnotationKey]; ok {
+		if err := k.validateProxyProtocol(service, pp); err != nil {
+			return sc, err
+		}
+		sc.ProxyProtocol = pp
+	}
+
+	if h, ok := service.Annotations[serviceSNIHostnamesAnnotationKey]; ok {
+		hostnames, err := k.sniHostnamesFor(h)
+		if err != nil {
+			return sc, err
+		}
+		sc.SNIHostnames = hostnames
+	}
+
+	hostname, err := k.hostnameFor(service)
+	if err != nil {
+		return sc, err
+	}
+	sc.Hostname = hostname
+
+	if s, ok := service.Annotations[serviceSchedulerAnnotationKey]; ok {
+		if !validSchedulers[s] {
+			return sc, fmt.Errorf("invalid scheduler '%s' in annotation %s", s, serviceSchedulerAnnotationKey)
+		}
+		sc.Scheduler = s
+	}
+
+	// kube-keepalived-vip has no persistence setting, so client IP affinity
+	// is left to kube-proxy
+	if service.Spec.SessionAffinity == v1.ServiceAffinityClientIP && k.configFormat != configFormatVIP {
+		sc.PersistenceTimeout = defaultClientIPAffinityTimeout
+	}
+
+	if timeout, ok, err := intAnnotation(service, servicePersistenceTimeoutAnnotationKey, 1); err != nil {
+		return sc, err
+	} else if ok {
+		sc.PersistenceTimeout = timeout
+	}
+
+	if g, ok := service.Annotations[servicePersistenceGranularityAnnotationKey]; ok {
+		if !isNetmask(g) {
+			return sc, fmt.Errorf("invalid persistence granularity '%s' in annotation %s: must be a netmask", g, servicePersistenceGranularityAnnotationKey)
+		}
+		if sc.PersistenceTimeout == 0 {
+			return sc, fmt.Errorf("annotation %s requires persistence to be enabled", servicePersistenceGranularityAnnotationKey)
+		}
+		sc.PersistenceGranularity = g
+	}
+
+	hc, err := k.healthCheckFor(service)
+	if err != nil {
+		return sc, err
+	}
+	sc.HealthCheck = hc
+
+	ranges, err := servicehelper.GetLoadBalancerSourceRanges(service)
+	if err != nil {
+		return sc, err
+	}
+	if !servicehelper.IsAllowAll(ranges) {
+		sc.SourceRanges = ranges.StringSlice()
+		sort.Strings(sc.SourceRanges)
+	}
+
+	for _, p := range service.Spec.Ports {
+		protocol := p.Protocol
+		if protocol == "" {
+			protocol = v1.ProtocolTCP
+		}
+		if !validProtocols[protocol] {
+			return sc, fmt.Errorf("unsupported protocol '%s' on port %d", protocol, p.Port)
+		}
+		if protocol != v1.ProtocolTCP && isProxyFormat(k.configFormat) {
+			return sc, fmt.Errorf("unsupported protocol '%s' on port %d: only TCP can be forwarded by %s", protocol, p.Port, k.configFormat)
+		}
+		sc.Ports = append(sc.Ports, servicePort{
+			Name:     p.Name,
+			Protocol: string(protocol),
+			Port:     p.Port,
+			NodePort: p.NodePort,
+		})
+	}
+
+	return sc, nil
+}
+
+// healthCheckFor returns the health check configured by the service's
+// annotations, or nil if none of them are set and the default should be used.
+func (k *KeepalivedLoadBalancer) healthCheckFor(service *v1.Service) (*healthCheck, error) {
+	hc := healthCheck{Type: healthCheckTCP}
+	set := false
+
+	if t, ok := service.Annotations[serviceHealthCheckAnnotationKey]; ok {
+		if !validHealthChecks[t] {
+			return nil, fmt.Errorf("invalid health check '%s' in annotation %s", t, serviceHealthCheckAnnotationKey)
+		}
+		hc.Type = t
+		set = true
+	}
+
+	if p, ok := service.Annotations[serviceHealthCheckPathAnnotationKey]; ok {
+		switch hc.Type {
+		case healthCheckHTTP, healthCheckSSL, healthCheckMisc:
+		default:
+			return nil, fmt.Errorf("annotation %s is not valid for %s health checks", serviceHealthCheckPathAnnotationKey, hc.Type)
+		}
+		if hc.Type != healthCheckMisc && !validURLPath(p) {
+			return nil, fmt.Errorf("invalid path '%s' in annotation %s: must be a URL path", p, serviceHealthCheckPathAnnotationKey)
+		}
+		hc.Path = p
+		set = true
+	}
+
+	if status, ok, err := intAnnotation(service, serviceHealthCheckStatusAnnotationKey, 100); err != nil {
+		return nil, err
+	} else if ok {
+		if hc.Type != healthCheckHTTP && hc.Type != healthCheckSSL {
+			return nil, fmt.Errorf("annotation %s is not valid for %s health checks", serviceHealthCheckStatusAnnotationKey, hc.Type)
+		}
+		if status > 599 {
+			return nil, fmt.Errorf("invalid status code '%d' in annotation %s", status, serviceHealthCheckStatusAnnotationKey)
+		}
+		hc.Status = status
+		set = true
+	}
+
+	if interval, ok, err := intAnnotation(service, serviceHealthCheckIntervalAnnotationKey, 1); err != nil {
+		return nil, err
+	} else if ok {
+		hc.Interval = interval
+		set = true
+	}
+
+	if retries, ok, err := intAnnotation(service, serviceHealthCheckRetriesAnnotationKey, 1); err != nil {
+		return nil, err
+	} else if ok {
+		hc.Retries = retries
+		set = true
+	}
+
+	if !set {
+		return nil, nil
+	}
+
+	if hc.Type == healthCheckMisc {
+		if hc.Path == "" {
+			return nil, fmt.Errorf("%s health checks require the script to run to be set in annotation %s", healthCheckMisc, serviceHealthCheckPathAnnotationKey)
+		}
+		// the script is run as root on every node, so only scripts the
+		// operator has allowed in the cloud config can be used
+		if !k.allowedHealthCheckScript(hc.Path) {
+			return nil, fmt.Errorf("script '%s' in annotation %s is not one of the allowed health check scripts", hc.Path, serviceHealthCheckPathAnnotationKey)
+		}
+	}
+
+	return &hc, nil
+}
+
+// intAnnotation parses the integer value of the annotation key on service,
+// which must be at least min. The returned bool is false if the annotation
+// is not set.
+func intAnnotation(service *v1.Service, key string, min int) (int, bool, error) {
+	s, ok := service.Annotations[key]
+	if !ok {
+		return 0, false, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < min {
+		return 0, false, fmt.Errorf("invalid value '%s' in annotation %s: must be a number no less than %d", s, key, min)
+	}
+	return i, true, nil
+}
+
+// isNetmask returns true if s is a dotted IPv4 netmask, eg. 255.255.255.0
+func isNetmask(s string) bool {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return false
+	}
+	ones, bits := net.IPMask(ip).Size()
+	return bits != 0 && ones > 0
+}
+
+// validateProxyProtocol checks that the PROXY protocol version pp can be used
+// by service.
+func (k *KeepalivedLoadBalancer) validateProxyProtocol(service *v1.Service, pp string) error {
+	if pp != proxyProtocolV1 && pp != proxyProtocolV2 {
+		return fmt.Errorf("invalid proxy protocol version '%s' in annotation %s: must be one of %s, %s", pp, serviceProxyProtocolAnnotationKey, proxyProtocolV1, proxyProtocolV2)
+	}
+	if fm, ok := service.Annotations[serviceForwardMethodAnnotationKey]; ok {
+		return fmt.Errorf("annotation %s cannot be used with forward method '%s' in annotation %s, as PROXY protocol connections are forwarded by haproxy", serviceProxyProtocolAnnotationKey, fm, serviceForwardMethodAnnotationKey)
+	}
+	if pp == proxyProtocolV2 && k.configFormat == configFormatVIP {
+		return fmt.Errorf("proxy protocol %s in annotation %s is not supported by %s, which only supports %s", pp, serviceProxyProtocolAnnotationKey, configFormatVIP, proxyProtocolV1)
+	}
+	for _, p := range service.Spec.Ports {
+		if p.Protocol == v1.ProtocolUDP {
+			return fmt.Errorf("annotation %s cannot be used with UDP port %d", serviceProxyProtocolAnnotationKey, p.Port)
+		}
+	}
+	return nil
+}
+
+// sniHostnamesFor parses the comma separated hostnames in the SNI hostnames
+// annotation. Hostnames may start with a '*.' wildcard label, and each is
+// only listed once.
+func (k *KeepalivedLoadBalancer) sniHostnamesFor(v string) ([]string, error) {
+	if !isProxyFormat(k.configFormat) {
+		return nil, fmt.Errorf("annotation %s is not supported by %s, only by %s and %s", serviceSNIHostnamesAnnotationKey, k.configFormat, configFormatHAProxy, configFormatEnvoy)
+	}
+
+	var hostnames []string
+	for _, h := range strings.Split(v, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if !validHostname(strings.TrimPrefix(h, "*.")) {
+			return nil, fmt.Errorf("invalid hostname '%s' in annotation %s", h, serviceSNIHostnamesAnnotationKey)
+		}
+		for _, existing := range hostnames {
+			if existing == h {
+				return nil, fmt.Errorf("duplicate hostname '%s' in annotation %s", h, serviceSNIHostnamesAnnotationKey)
+			}
+		}
+		hostnames = append(hostnames, h)
+	}
+	return hostnames, nil
+}
@@ -0,0 +1,460 @@
+package keepalivedcp
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+func TestServiceConfigFor(t *testing.T) {
+	type testDef struct {
+		name        string
+		annotations map[string]string
+		affinity    v1.ServiceAffinity
+		ports       []v1.ServicePort
+		ranges      []string
+		format      string
+		template    string
+		expected    serviceConfig
+		err         bool
+	}
+
+	tests := []testDef{
+		{
+			name:     "no annotations",
+			expected: serviceConfig{},
+		},
+		{
+			name: "scheduler and persistence",
+			annotations: map[string]string{
+				serviceSchedulerAnnotationKey:              "wrr",
+				servicePersistenceTimeoutAnnotationKey:     "300",
+				servicePersistenceGranularityAnnotationKey: "255.255.255.0",
+			},
+			expected: serviceConfig{
+				Scheduler:              "wrr",
+				PersistenceTimeout:     300,
+				PersistenceGranularity: "255.255.255.0",
+			},
+		},
+		{
+			name:     "client ip session affinity",
+			affinity: v1.ServiceAffinityClientIP,
+			expected: serviceConfig{
+				PersistenceTimeout: defaultClientIPAffinityTimeout,
+			},
+		},
+		{
+			name:     "persistence timeout overrides session affinity default",
+			affinity: v1.ServiceAffinityClientIP,
+			annotations: map[string]string{
+				servicePersistenceTimeoutAnnotationKey: "60",
+			},
+			expected: serviceConfig{
+				PersistenceTimeout: 60,
+			},
+		},
+		{
+			name: "mixed protocol ports",
+			ports: []v1.ServicePort{
+				{Name: "dns", Port: 53, NodePort: 30053, Protocol: v1.ProtocolUDP},
+				{Name: "dns-tcp", Port: 53, NodePort: 30054},
+			},
+			expected: serviceConfig{
+				Ports: []servicePort{
+					{Name: "dns", Port: 53, NodePort: 30053, Protocol: "UDP"},
+					{Name: "dns-tcp", Port: 53, NodePort: 30054, Protocol: "TCP"},
+				},
+			},
+		},
+		{
+			name: "unsupported protocol",
+			ports: []v1.ServicePort{
+				{Port: 132, NodePort: 30132, Protocol: "SCTP"},
+			},
+			err: true,
+		},
+		{
+			name: "http health check",
+			annotations: map[string]string{
+				serviceHealthCheckAnnotationKey:         healthCheckHTTP,
+				serviceHealthCheckPathAnnotationKey:     "/healthz",
+				serviceHealthCheckStatusAnnotationKey:   "204",
+				serviceHealthCheckIntervalAnnotationKey: "10",
+				serviceHealthCheckRetriesAnnotationKey:  "2",
+			},
+			expected: serviceConfig{
+				HealthCheck: &healthCheck{
+					Type:     healthCheckHTTP,
+					Path:     "/healthz",
+					Status:   204,
+					Interval: 10,
+					Retries:  2,
+				},
+			},
+		},
+		{
+			name: "health check interval defaults to tcp check",
+			annotations: map[string]string{
+				serviceHealthCheckIntervalAnnotationKey: "10",
+			},
+			expected: serviceConfig{
+				HealthCheck: &healthCheck{
+					Type:     healthCheckTCP,
+					Interval: 10,
+				},
+			},
+		},
+		{
+			name: "invalid health check",
+			annotations: map[string]string{
+				serviceHealthCheckAnnotationKey: "PING",
+			},
+			err: true,
+		},
+		{
+			name: "http health check path with newline",
+			annotations: map[string]string{
+				serviceHealthCheckAnnotationKey:     healthCheckHTTP,
+				serviceHealthCheckPathAnnotationKey: "/healthz\n}\nvirtual_server",
+			},
+			err: true,
+		},
+		{
+			name: "http health check path with semicolon",
+			annotations: map[string]string{
+				serviceHealthCheckAnnotationKey:     healthCheckHTTP,
+				serviceHealthCheckPathAnnotationKey: "/healthz;check=MISC_CHECK",
+			},
+			err: true,
+		},
+		{
+			name: "zero health check retries",
+			annotations: map[string]string{
+				serviceHealthCheckRetriesAnnotationKey: "0",
+			},
+			err: true,
+		},
+		{
+			name: "allowed misc health check script",
+			annotations: map[string]string{
+				serviceHealthCheckAnnotationKey:     healthCheckMisc,
+				serviceHealthCheckPathAnnotationKey: "/etc/keepalived/check.sh",
+			},
+			expected: serviceConfig{
+				HealthCheck: &healthCheck{
+					Type: healthCheckMisc,
+					Path: "/etc/keepalived/check.sh",
+				},
+			},
+		},
+		{
+			name: "misc health check script not allowed",
+			annotations: map[string]string{
+				serviceHealthCheckAnnotationKey:     healthCheckMisc,
+				serviceHealthCheckPathAnnotationKey: "/bin/rm -rf /",
+			},
+			err: true,
+		},
+		{
+			name: "status code for tcp health check",
+			annotations: map[string]string{
+				serviceHealthCheckStatusAnnotationKey: "200",
+			},
+			err: true,
+		},
+		{
+			name: "misc health check without script",
+			annotations: map[string]string{
+				serviceHealthCheckAnnotationKey: healthCheckMisc,
+			},
+			err: true,
+		},
+		{
+			name:   "source ranges",
+			ranges: []string{"192.168.0.0/16", "10.0.0.0/8"},
+			expected: serviceConfig{
+				SourceRanges: []string{"10.0.0.0/8", "192.168.0.0/16"},
+			},
+		},
+		{
+			name: "source ranges annotation",
+			annotations: map[string]string{
+				"service.beta.kubernetes.io/load-balancer-source-ranges": "10.0.0.0/8",
+			},
+			expected: serviceConfig{
+				SourceRanges: []string{"10.0.0.0/8"},
+			},
+		},
+		{
+			name:     "allow all source ranges",
+			ranges:   []string{"0.0.0.0/0"},
+			expected: serviceConfig{},
+		},
+		{
+			name:   "invalid source range",
+			ranges: []string{"10.0.0.0"},
+			err:    true,
+		},
+		{
+			name:   "proxy protocol v1",
+			format: configFormatVIP,
+			annotations: map[string]string{
+				serviceProxyProtocolAnnotationKey: "v1",
+			},
+			expected: serviceConfig{
+				ProxyProtocol: "v1",
+			},
+		},
+		{
+			name:   "proxy protocol v2",
+			format: configFormatKeepalived,
+			annotations: map[string]string{
+				serviceProxyProtocolAnnotationKey: "v2",
+			},
+			expected: serviceConfig{
+				ProxyProtocol: "v2",
+			},
+		},
+		{
+			name:   "proxy protocol v2 with kube-keepalived-vip",
+			format: configFormatVIP,
+			annotations: map[string]string{
+				serviceProxyProtocolAnnotationKey: "v2",
+			},
+			err: true,
+		},
+		{
+			name: "invalid proxy protocol",
+			annotations: map[string]string{
+				serviceProxyProtocolAnnotationKey: "v3",
+			},
+			err: true,
+		},
+		{
+			name: "proxy protocol with forward method",
+			annotations: map[string]string{
+				serviceProxyProtocolAnnotationKey: "v1",
+				serviceForwardMethodAnnotationKey: "DR",
+			},
+			err: true,
+		},
+		{
+			name: "proxy protocol with udp port",
+			annotations: map[string]string{
+				serviceProxyProtocolAnnotationKey: "v1",
+			},
+			ports: []v1.ServicePort{
+				{Port: 53, NodePort: 30053, Protocol: v1.ProtocolUDP},
+			},
+			err: true,
+		},
+		{
+			name:   "sni hostnames",
+			format: configFormatHAProxy,
+			annotations: map[string]string{
+				serviceSNIHostnamesAnnotationKey: "a.example.com, *.B.example.com",
+			},
+			expected: serviceConfig{
+				SNIHostnames: []string{"a.example.com", "*.b.example.com"},
+			},
+		},
+		{
+			name:   "sni hostnames with kube-keepalived-vip",
+			format: configFormatVIP,
+			annotations: map[string]string{
+				serviceSNIHostnamesAnnotationKey: "a.example.com",
+			},
+			err: true,
+		},
+		{
+			name:   "invalid sni hostname",
+			format: configFormatEnvoy,
+			annotations: map[string]string{
+				serviceSNIHostnamesAnnotationKey: "a.*.example.com",
+			},
+			err: true,
+		},
+		{
+			name:   "sni hostname with invalid characters",
+			format: configFormatHAProxy,
+			annotations: map[string]string{
+				serviceSNIHostnamesAnnotationKey: "a_b.example.com",
+			},
+			err: true,
+		},
+		{
+			name:   "duplicate sni hostname",
+			format: configFormatHAProxy,
+			annotations: map[string]string{
+				serviceSNIHostnamesAnnotationKey: "a.example.com,A.example.com",
+			},
+			err: true,
+		},
+		{
+			name:   "udp port with haproxy",
+			format: configFormatHAProxy,
+			ports: []v1.ServicePort{
+				{Port: 53, NodePort: 30053, Protocol: v1.ProtocolUDP},
+			},
+			err: true,
+		},
+		{
+			name:     "hostname",
+			template: "{{.Name}}.lb{{.Namespace}}.example.com",
+			annotations: map[string]string{
+				serviceHostnameAnnotationKey: "Web.LB.example.com.",
+			},
+			expected: serviceConfig{
+				Hostname: "web.lb.example.com",
+			},
+		},
+		{
+			name: "invalid hostname",
+			annotations: map[string]string{
+				serviceHostnameAnnotationKey: "web_1.lb.example.com",
+			},
+			err: true,
+		},
+		{
+			name:   "scheduler and persistence with kube-keepalived-vip",
+			format: configFormatVIP,
+			annotations: map[string]string{
+				serviceSchedulerAnnotationKey:          "wrr",
+				servicePersistenceTimeoutAnnotationKey: "300",
+			},
+			expected: serviceConfig{
+				Scheduler:          "wrr",
+				PersistenceTimeout: 300,
+			},
+		},
+		{
+			name:   "invalid scheduler with kube-keepalived-vip",
+			format: configFormatVIP,
+			annotations: map[string]string{
+				serviceSchedulerAnnotationKey: "fastest",
+			},
+			err: true,
+		},
+		{
+			name:   "health check with kube-keepalived-vip",
+			format: configFormatVIP,
+			annotations: map[string]string{
+				serviceHealthCheckAnnotationKey: healthCheckHTTP,
+			},
+			err: true,
+		},
+		{
+			name:     "client ip session affinity with kube-keepalived-vip",
+			format:   configFormatVIP,
+			affinity: v1.ServiceAffinityClientIP,
+			expected: serviceConfig{},
+		},
+		{
+			name: "forward method",
+			annotations: map[string]string{
+				serviceForwardMethodAnnotationKey: "DR",
+			},
+			expected: serviceConfig{
+				ForwardMethod: "DR",
+			},
+		},
+		{
+			name: "invalid forward method",
+			annotations: map[string]string{
+				serviceForwardMethodAnnotationKey: "TUNNEL",
+			},
+			err: true,
+		},
+		{
+			name: "invalid scheduler",
+			annotations: map[string]string{
+				serviceSchedulerAnnotationKey: "fastest",
+			},
+			err: true,
+		},
+		{
+			name: "negative persistence timeout",
+			annotations: map[string]string{
+				servicePersistenceTimeoutAnnotationKey: "-1",
+			},
+			err: true,
+		},
+		{
+			name: "invalid persistence granularity",
+			annotations: map[string]string{
+				servicePersistenceTimeoutAnnotationKey:     "300",
+				servicePersistenceGranularityAnnotationKey: "255.0.255.0",
+			},
+			err: true,
+		},
+		{
+			name: "persistence granularity without persistence",
+			annotations: map[string]string{
+				servicePersistenceGranularityAnnotationKey: "255.255.255.0",
+			},
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				k := &KeepalivedLoadBalancer{configFormat: test.format, healthCheckScripts: []string{"/etc/keepalived/check.sh"}}
+				if test.template != "" {
+					tmpl, err := parseHostnameTemplate(test.template)
+					if err != nil {
+						t.Fatalf("got error parsing template: %s", err.Error())
+					}
+					k.hostnameTemplate = tmpl
+				}
+				svc := &v1.Service{}
+				svc.Annotations = test.annotations
+				svc.Spec.SessionAffinity = test.affinity
+				svc.Spec.Ports = test.ports
+				svc.Spec.LoadBalancerSourceRanges = test.ranges
+
+				sc, err := k.serviceConfigFor(svc)
+
+				if err != nil {
+					if test.err {
+						return
+					}
+
+					t.Errorf("got error: %s", err.Error())
+					return
+				}
+
+				if test.err {
+					t.Errorf("expected error but got none")
+					return
+				}
+
+				if !reflect.DeepEqual(sc, test.expected) {
+					t.Errorf("expected config '%+v' but got '%+v'", test.expected, sc)
+				}
+			}
+		}(test))
+	}
+}
+
+func TestUnappliedAnnotations(t *testing.T) {
+	svc := &v1.Service{}
+	svc.Annotations = map[string]string{
+		serviceSchedulerAnnotationKey:              "wrr",
+		servicePersistenceGranularityAnnotationKey: "255.255.255.0",
+		serviceForwardMethodAnnotationKey:          "DR",
+	}
+
+	k := &KeepalivedLoadBalancer{configFormat: configFormatVIP}
+	expected := []string{serviceSchedulerAnnotationKey, servicePersistenceGranularityAnnotationKey}
+	if unapplied := k.unappliedAnnotations(svc); !reflect.DeepEqual(unapplied, expected) {
+		t.Errorf("expected unapplied annotations %v but got %v", expected, unapplied)
+	}
+
+	k.configFormat = configFormatKeepalived
+	if unapplied := k.unappliedAnnotations(svc); len(unapplied) != 0 {
+		t.Errorf("expected no unapplied annotations but got %v", unapplied)
+	}
+}
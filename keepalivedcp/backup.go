@@ -0,0 +1,190 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// backupper periodically snapshots the config to a second store, so that
+// allocations can be restored if the keepalived ConfigMap is lost.
+type backupper struct {
+	lb    *KeepalivedLoadBalancer
+	store stateStore
+}
+
+func newBackupper(lb *KeepalivedLoadBalancer, store stateStore) *backupper {
+	return &backupper{lb: lb, store: store}
+}
+
+// Run snapshots the config every interval until stopCh is closed.
+func (b *backupper) Run(interval time.Duration, stopCh <-chan struct{}) {
+	glog.Infof("backing up config to %s every %s", b.store, interval)
+	wait.Until(func() {
+		if err := b.backup(); err != nil {
+			glog.Errorf("error backing up config to %s: %s", b.store, err.Error())
+		}
+	}, interval, stopCh)
+}
+
+func (b *backupper) backup() error {
+	cm, err := b.lb.getConfigMap()
+
+	if err != nil {
+		return err
+	}
+
+	cfg, err := configFrom(cm)
+
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := b.store.load()
+
+	if err != nil {
+		return err
+	}
+
+	// an empty config is most likely the result of the ConfigMap being
+	// replaced, which is what the snapshot is for, so never overwrite the
+	// snapshot with it
+	if len(cfg.Services) == 0 && len(snapshot.Services) > 0 {
+		glog.Warningf("not backing up config to %s: configmap %s/%s has no allocations, but the snapshot has %d", b.store, b.lb.namespace, b.lb.name, len(snapshot.Services))
+		return nil
+	}
+
+	if reflect.DeepEqual(cfg.Services, snapshot.Services) && reflect.DeepEqual(cfg.Reserved, snapshot.Reserved) {
+		return nil
+	}
+
+	glog.V(2).Infof("backing up %d allocations to %s", len(cfg.Services), b.store)
+	return b.store.save(cfg)
+}
+
+// liveService is the current state of a service, as used to restore its
+// allocation.
+type liveService struct {
+	UID  string
+	Type apiv1.ServiceType
+}
+
+// restoreConfig merges the allocations in snapshot of the services that
+// still exist, as returned by lookup, which returns nil for a service that
+// does not exist, into a copy of existing. Services that have been recreated,
+// and so have a new UID, keep their IP. Allocations in existing are kept, as
+// they are newer than the snapshot, unless replace is set, in which case a
+// service that has an allocation in both gets its IP from the snapshot. An
+// IP from the snapshot that is allocated to another service or reserved in
+// existing is never restored. A description of each allocation that was
+// changed or dropped is returned.
+func restoreConfig(snapshot, existing *config, lookup func(namespace, name string) (*liveService, error), replace bool) (*config, []string, error) {
+	restored := &config{
+		Version:  currentConfigVersion,
+		Services: append([]serviceConfig{}, existing.Services...),
+		Reserved: append([]string{}, existing.Reserved...),
+		Nodes:    existing.Nodes,
+	}
+	if len(existing.Unmanaged) > 0 {
+		restored.Unmanaged = make(map[string]string, len(existing.Unmanaged))
+		for ip, v := range existing.Unmanaged {
+			restored.Unmanaged[ip] = v
+		}
+	}
+
+	var changes []string
+	fromSnapshot := map[string]bool{}
+	for _, sc := range snapshot.Services {
+		svc, err := lookup(sc.ServiceNamespace, sc.ServiceName)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch {
+		case svc == nil:
+			changes = append(changes, fmt.Sprintf("dropped %s for %s/%s: service does not exist", sc.IP, sc.ServiceNamespace, sc.ServiceName))
+			continue
+		case svc.Type != apiv1.ServiceTypeLoadBalancer:
+			changes = append(changes, fmt.Sprintf("dropped %s for %s/%s: service is of type %s", sc.IP, sc.ServiceNamespace, sc.ServiceName, svc.Type))
+			continue
+		case svc.UID != sc.UID:
+			changes = append(changes, fmt.Sprintf("updated uid of %s for %s/%s from %s to %s", sc.IP, sc.ServiceNamespace, sc.ServiceName, sc.UID, svc.UID))
+			sc.UID = svc.UID
+		}
+
+		if fromSnapshot[sc.UID] {
+			changes = append(changes, fmt.Sprintf("dropped %s for %s/%s: service has more than one allocation in the snapshot", sc.IP, sc.ServiceNamespace, sc.ServiceName))
+			continue
+		}
+		fromSnapshot[sc.UID] = true
+
+		current, hasCurrent := restored.serviceByUID(sc.UID)
+		if hasCurrent && current.IP == sc.IP {
+			continue
+		}
+		if hasCurrent && !replace {
+			changes = append(changes, fmt.Sprintf("kept %s for %s/%s instead of %s from the snapshot", current.IP, sc.ServiceNamespace, sc.ServiceName, sc.IP))
+			continue
+		}
+		if holder, ok := ipHolder(restored, sc); ok {
+			changes = append(changes, fmt.Sprintf("dropped %s for %s/%s: ip is allocated to %s/%s", sc.IP, sc.ServiceNamespace, sc.ServiceName, holder.ServiceNamespace, holder.ServiceName))
+			continue
+		}
+		if restored.isReserved(sc.IP) {
+			changes = append(changes, fmt.Sprintf("dropped %s for %s/%s: ip is reserved", sc.IP, sc.ServiceNamespace, sc.ServiceName))
+			continue
+		}
+		if hasCurrent {
+			changes = append(changes, fmt.Sprintf("replaced %s for %s/%s with %s from the snapshot", current.IP, sc.ServiceNamespace, sc.ServiceName, sc.IP))
+		}
+		restored.ensureService(sc)
+	}
+
+	for _, ip := range snapshot.Reserved {
+		if holder, ok := ipHolder(restored, serviceConfig{IP: ip}); ok {
+			changes = append(changes, fmt.Sprintf("dropped reservation of %s: ip is allocated to %s/%s", ip, holder.ServiceNamespace, holder.ServiceName))
+			continue
+		}
+		if !restored.isReserved(ip) {
+			restored.Reserved = append(restored.Reserved, ip)
+		}
+	}
+
+	return restored, changes, nil
+}
+
+// ipHolder returns the service in cfg, other than sc, that sc's IP is
+// allocated to, if it cannot share it with sc.
+func ipHolder(cfg *config, sc serviceConfig) (serviceConfig, bool) {
+	for _, s := range cfg.Services {
+		if s.IP != sc.IP || s.UID == sc.UID {
+			continue
+		}
+		// services routed by SNI can share a VIP
+		if len(s.SNIHostnames) > 0 && len(sc.SNIHostnames) > 0 {
+			continue
+		}
+		return s, true
+	}
+	return serviceConfig{}, false
+}
+
+// lookupService returns the live state of a service, or nil if it does not
+// exist.
+func (k *KeepalivedLoadBalancer) lookupService(namespace, name string) (*liveService, error) {
+	svc, err := k.kubeClient.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting service %s/%s: %s", namespace, name, err.Error())
+	}
+	return &liveService{UID: string(svc.UID), Type: svc.Spec.Type}, nil
+}
@@ -0,0 +1,134 @@
+package keepalivedcp
+
+import (
+	"reflect"
+	"testing"
+
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestRestoreConfig(t *testing.T) {
+	live := map[string]*liveService{
+		"default/same":      {UID: "uid-same", Type: apiv1.ServiceTypeLoadBalancer},
+		"default/recreated": {UID: "uid-new", Type: apiv1.ServiceTypeLoadBalancer},
+		"default/nodeport":  {UID: "uid-nodeport", Type: apiv1.ServiceTypeNodePort},
+	}
+	lookup := func(namespace, name string) (*liveService, error) {
+		return live[namespace+"/"+name], nil
+	}
+
+	snapshot := &config{
+		Services: []serviceConfig{
+			{UID: "uid-same", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "same"},
+			{UID: "uid-old", IP: "10.0.0.2", ServiceNamespace: "default", ServiceName: "recreated", ForwardMethod: "DR"},
+			{UID: "uid-nodeport", IP: "10.0.0.3", ServiceNamespace: "default", ServiceName: "nodeport"},
+			{UID: "uid-deleted", IP: "10.0.0.4", ServiceNamespace: "default", ServiceName: "deleted"},
+		},
+		Reserved: []string{"10.0.0.9"},
+	}
+
+	restored, changes, err := restoreConfig(snapshot, &config{}, lookup, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expected := &config{
+		Version: currentConfigVersion,
+		Services: []serviceConfig{
+			{UID: "uid-same", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "same"},
+			{UID: "uid-new", IP: "10.0.0.2", ServiceNamespace: "default", ServiceName: "recreated", ForwardMethod: "DR"},
+		},
+		Reserved: []string{"10.0.0.9"},
+	}
+	if !reflect.DeepEqual(restored, expected) {
+		t.Errorf("expected %+v but got %+v", expected, restored)
+	}
+
+	if len(changes) != 3 {
+		t.Errorf("expected 3 changes but got %d: %v", len(changes), changes)
+	}
+	if snapshot.Services[1].UID != "uid-old" {
+		t.Errorf("snapshot was modified")
+	}
+}
+
+func TestRestoreConfigMerge(t *testing.T) {
+	live := map[string]*liveService{
+		"default/a": {UID: "uid-a", Type: apiv1.ServiceTypeLoadBalancer},
+		"default/b": {UID: "uid-b", Type: apiv1.ServiceTypeLoadBalancer},
+		"default/c": {UID: "uid-c", Type: apiv1.ServiceTypeLoadBalancer},
+		"default/d": {UID: "uid-d", Type: apiv1.ServiceTypeLoadBalancer},
+	}
+	lookup := func(namespace, name string) (*liveService, error) {
+		return live[namespace+"/"+name], nil
+	}
+
+	snapshot := &config{
+		Services: []serviceConfig{
+			// reallocated since the snapshot
+			{UID: "uid-a", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "a"},
+			// its ip is now allocated to another service
+			{UID: "uid-b", IP: "10.0.0.2", ServiceNamespace: "default", ServiceName: "b"},
+			// not allocated since
+			{UID: "uid-c", IP: "10.0.0.3", ServiceNamespace: "default", ServiceName: "c"},
+			// a duplicate of c's allocation
+			{UID: "uid-c", IP: "10.0.0.4", ServiceNamespace: "default", ServiceName: "c"},
+		},
+		Reserved: []string{"10.0.0.5", "10.0.0.9"},
+	}
+	existing := &config{
+		Services: []serviceConfig{
+			{UID: "uid-a", IP: "10.0.0.11", ServiceNamespace: "default", ServiceName: "a"},
+			{UID: "uid-d", IP: "10.0.0.2", ServiceNamespace: "default", ServiceName: "d"},
+			{UID: "uid-e", IP: "10.0.0.5", ServiceNamespace: "default", ServiceName: "e"},
+		},
+	}
+
+	type testDef struct {
+		name     string
+		replace  bool
+		expected []serviceConfig
+	}
+
+	tests := []testDef{
+		{
+			name: "keep newer allocations",
+			expected: []serviceConfig{
+				{UID: "uid-a", IP: "10.0.0.11", ServiceNamespace: "default", ServiceName: "a"},
+				{UID: "uid-d", IP: "10.0.0.2", ServiceNamespace: "default", ServiceName: "d"},
+				{UID: "uid-e", IP: "10.0.0.5", ServiceNamespace: "default", ServiceName: "e"},
+				{UID: "uid-c", IP: "10.0.0.3", ServiceNamespace: "default", ServiceName: "c"},
+			},
+		},
+		{
+			name:    "replace",
+			replace: true,
+			expected: []serviceConfig{
+				{UID: "uid-a", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "a"},
+				{UID: "uid-d", IP: "10.0.0.2", ServiceNamespace: "default", ServiceName: "d"},
+				{UID: "uid-e", IP: "10.0.0.5", ServiceNamespace: "default", ServiceName: "e"},
+				{UID: "uid-c", IP: "10.0.0.3", ServiceNamespace: "default", ServiceName: "c"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				restored, _, err := restoreConfig(snapshot, existing, lookup, test.replace)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+				if !reflect.DeepEqual(restored.Services, test.expected) {
+					t.Errorf("expected services %+v but got %+v", test.expected, restored.Services)
+				}
+				if expected := []string{"10.0.0.9"}; !reflect.DeepEqual(restored.Reserved, expected) {
+					t.Errorf("expected reserved %v but got %v", expected, restored.Reserved)
+				}
+				if len(existing.Services) != 3 || existing.Services[0].IP != "10.0.0.11" {
+					t.Errorf("existing config was modified")
+				}
+			}
+		}(test))
+	}
+}
@@ -0,0 +1,86 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// bootstrap imports the entries of a ConfigMap that was populated by hand for
+// kube-keepalived-vip, and so has data but no config annotation, into the
+// config annotation. Entries for LoadBalancer services are imported as their
+// allocations, keeping their IPs. All other entries are kept as they are, and
+// their IPs reserved so that they are never allocated to another service. It
+// fails if a service cannot be looked up, rather than guess at its entry.
+func (k *KeepalivedLoadBalancer) bootstrap() error {
+	if k.configFormat != configFormatVIP {
+		return nil
+	}
+
+	cm, err := k.getConfigMap()
+
+	if err != nil {
+		return err
+	}
+
+	if _, ok := cm.Annotations[configMapAnnotationKey]; ok || len(cm.Data) == 0 {
+		return nil
+	}
+
+	glog.Infof("configmap %s/%s has %d entries but no config annotation, importing them", k.namespace, k.name, len(cm.Data))
+
+	cfg, err := importConfigMapData(cm.Data, k.resolveConfigMapEntry)
+	if err != nil {
+		return err
+	}
+	glog.Infof("imported %d allocations and kept %d unmanaged entries from configmap %s/%s", len(cfg.Services), len(cfg.Unmanaged), k.namespace, k.name)
+
+	return k.updateConfigMap(cm, cfg)
+}
+
+// importConfigMapData builds a config from kube-keepalived-vip ConfigMap data,
+// using resolve to look up the service of each entry. Entries for which
+// resolve returns an unmanagedEntryError, or that refer to a service that
+// already has an allocation, are kept as unmanaged entries and their IPs
+// reserved. Any other error from resolve is returned.
+func importConfigMapData(data map[string]string, resolve func(ip, value string) (serviceConfig, error)) (*config, error) {
+	ips := make([]string, 0, len(data))
+	for ip := range data {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	cfg := &config{Version: currentConfigVersion}
+	for _, ip := range ips {
+		v := data[ip]
+		sc, err := resolve(ip, v)
+		if _, ok := err.(unmanagedEntryError); ok {
+			glog.Warningf("keeping configmap entry '%s: %s' unmanaged and reserving its ip: %s", ip, v, err.Error())
+			cfg.keepUnmanaged(ip, v)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error resolving configmap entry '%s: %s': %s", ip, v, err.Error())
+		}
+		if existing, ok := cfg.serviceByUID(sc.UID); ok {
+			glog.Warningf("keeping configmap entry '%s: %s' unmanaged and reserving its ip, as the service was already imported with ip %s", ip, v, existing.IP)
+			cfg.keepUnmanaged(ip, v)
+			continue
+		}
+		glog.Infof("importing configmap entry '%s: %s' for service %s", ip, v, sc.UID)
+		cfg.ensureService(sc)
+	}
+	return cfg, nil
+}
+
+// keepUnmanaged keeps the ConfigMap entry for ip as it is, and reserves ip.
+func (c *config) keepUnmanaged(ip, value string) {
+	if c.Unmanaged == nil {
+		c.Unmanaged = map[string]string{}
+	}
+	c.Unmanaged[ip] = value
+	if !c.isReserved(ip) {
+		c.Reserved = append(c.Reserved, ip)
+	}
+}
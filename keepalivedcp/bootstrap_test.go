@@ -0,0 +1,68 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestImportConfigMapData(t *testing.T) {
+	services := map[string]string{
+		"default/a": "uid-a",
+		"default/b": "uid-b",
+	}
+	resolve := func(ip, value string) (serviceConfig, error) {
+		ns, name, method, err := parseConfigMapValue(value)
+		if err != nil {
+			return serviceConfig{}, unmanagedEntryError{err.Error()}
+		}
+		if ns == "unreachable" {
+			return serviceConfig{}, fmt.Errorf("connection refused")
+		}
+		uid, ok := services[ns+"/"+name]
+		if !ok {
+			return serviceConfig{}, unmanagedEntryError{"service not found"}
+		}
+		return serviceConfig{UID: uid, IP: ip, ServiceNamespace: ns, ServiceName: name, ForwardMethod: method}, nil
+	}
+
+	data := map[string]string{
+		"10.0.0.1": "default/a",
+		"10.0.0.2": "default/b:DR",
+		"10.0.0.3": "default/missing",
+		"10.0.0.4": "default/a",
+		"10.0.0.5": "invalid",
+	}
+
+	cfg, err := importConfigMapData(data, resolve)
+	if err != nil {
+		t.Fatalf("got error: %s", err.Error())
+	}
+
+	expectedServices := []serviceConfig{
+		{UID: "uid-a", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "a"},
+		{UID: "uid-b", IP: "10.0.0.2", ServiceNamespace: "default", ServiceName: "b", ForwardMethod: "DR"},
+	}
+	if !reflect.DeepEqual(cfg.Services, expectedServices) {
+		t.Errorf("expected services %v but got %v", expectedServices, cfg.Services)
+	}
+
+	expectedReserved := []string{"10.0.0.3", "10.0.0.4", "10.0.0.5"}
+	if !reflect.DeepEqual(cfg.Reserved, expectedReserved) {
+		t.Errorf("expected reserved %v but got %v", expectedReserved, cfg.Reserved)
+	}
+
+	if ip, err := cfg.allocateIP("10.0.0.0/29"); err != nil || ip != "10.0.0.6" {
+		t.Errorf("expected to allocate 10.0.0.6 but got '%s' (%v)", ip, err)
+	}
+
+	// unmanaged entries are written back unchanged
+	if rendered := cfg.toConfigMapData(); !reflect.DeepEqual(rendered, data) {
+		t.Errorf("expected data %v but got %v", data, rendered)
+	}
+
+	data["10.0.0.6"] = "unreachable/c"
+	if _, err := importConfigMapData(data, resolve); err == nil {
+		t.Errorf("expected error for unresolvable entry but got none")
+	}
+}
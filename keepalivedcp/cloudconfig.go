@@ -0,0 +1,75 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/ghodss/yaml"
+)
+
+// cloudConfig is the YAML or JSON configuration read from the file passed
+// with --cloud-config. Simple settings are read from the environment
+// instead, see newKeepalivedCloudProvider.
+type cloudConfig struct {
+	// Pools are the IP pools VIPs are allocated from. If none are
+	// configured, VIPs are allocated from KEEPALIVED_SERVICE_CIDR.
+	Pools []pool `json:"pools,omitempty"`
+	// Quotas limit the number of VIPs that can be allocated in each
+	// namespace
+	Quotas []quota `json:"quotas,omitempty"`
+	// Notifications are the HTTP endpoints notified when VIPs are
+	// allocated, reallocated or released
+	Notifications []notificationEndpoint `json:"notifications,omitempty"`
+	// HealthCheckScripts are the scripts services are allowed to run as
+	// MISC_CHECK health checks. keepalived runs them as root on every node.
+	HealthCheckScripts []string `json:"healthCheckScripts,omitempty"`
+	// HostnameTemplate generates the hostname of services without a
+	// hostname annotation, eg. {{.Name}}.{{.Namespace}}.lb.example.com
+	HostnameTemplate string `json:"hostnameTemplate,omitempty"`
+	// DNS configures publishing DNS records for the hostnames of VIPs, and
+	// is disabled if nil
+	DNS *dnsConfig `json:"dns,omitempty"`
+}
+
+func readCloudConfig(r io.Reader) (*cloudConfig, error) {
+	cc := cloudConfig{}
+	if r == nil {
+		return &cc, nil
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cloud config: %s", err.Error())
+	}
+
+	if err := yaml.Unmarshal(data, &cc); err != nil {
+		return nil, fmt.Errorf("error parsing cloud config: %s", err.Error())
+	}
+
+	if err := validatePools(cc.Pools); err != nil {
+		return nil, err
+	}
+
+	if err := validateNotificationEndpoints(cc.Notifications); err != nil {
+		return nil, err
+	}
+
+	if err := validateHealthCheckScripts(cc.HealthCheckScripts); err != nil {
+		return nil, err
+	}
+
+	if cc.HostnameTemplate != "" {
+		if _, err := parseHostnameTemplate(cc.HostnameTemplate); err != nil {
+			return nil, err
+		}
+	}
+
+	if cc.DNS != nil {
+		if err := validateDNSConfig(cc.DNS); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cc, nil
+}
@@ -3,9 +3,15 @@ package keepalivedcp
 import (
 	"fmt"
 	"io"
-
+	"net"
+	"net/http"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
 
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/kubernetes/pkg/cloudprovider"
@@ -13,6 +19,13 @@ import (
 
 const (
 	ProviderName = "keepalived"
+
+	defaultGCGracePeriod  = 10 * time.Minute
+	defaultBackupInterval = 5 * time.Minute
+	// defaultRefreshInterval is how often the allocations are re-read from
+	// the ConfigMap and published, to pick up changes made by others, eg.
+	// with ctl
+	defaultRefreshInterval = 30 * time.Second
 )
 
 func init() {
@@ -20,16 +33,87 @@ func init() {
 }
 
 type KeepalivedCloudProvider struct {
-	lb cloudprovider.LoadBalancer
+	lb        cloudprovider.LoadBalancer
+	instances cloudprovider.Instances
+	zones     cloudprovider.Zones
+	routes    cloudprovider.Routes
 }
 
 var _ cloudprovider.Interface = &KeepalivedCloudProvider{}
 
-func newKeepalivedCloudProvider(io.Reader) (cloudprovider.Interface, error) {
+func newKeepalivedCloudProvider(config io.Reader) (cloudprovider.Interface, error) {
+	cc, err := readCloudConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
 	ns := os.Getenv("KEEPALIVED_NAMESPACE")
 	cm := os.Getenv("KEEPALIVED_CONFIG_MAP")
 	cidr := os.Getenv("KEEPALIVED_SERVICE_CIDR")
 	fm := os.Getenv("KEEPALIVED_DEFAULT_FORWARD_METHOD")
+	format := os.Getenv("KEEPALIVED_CONFIG_FORMAT")
+	gcInterval, err := durationFromEnv("KEEPALIVED_GC_INTERVAL", 0)
+	if err != nil {
+		return nil, err
+	}
+	gcGracePeriod, err := durationFromEnv("KEEPALIVED_GC_GRACE_PERIOD", defaultGCGracePeriod)
+	if err != nil {
+		return nil, err
+	}
+	gcDryRun := os.Getenv("KEEPALIVED_GC_DRY_RUN") == "true"
+	driftInterval, err := durationFromEnv("KEEPALIVED_DRIFT_INTERVAL", 0)
+	if err != nil {
+		return nil, err
+	}
+	driftPolicy := os.Getenv("KEEPALIVED_DRIFT_POLICY")
+	inventorySource := os.Getenv("KEEPALIVED_INVENTORY")
+	topologySource := os.Getenv("KEEPALIVED_TOPOLOGY")
+	nodeName := os.Getenv("KEEPALIVED_NODE_NAME")
+	routesConfigMap := os.Getenv("KEEPALIVED_ROUTES_CONFIG_MAP")
+	routesFile := os.Getenv("KEEPALIVED_ROUTES_FILE")
+	firewallConfigMap := os.Getenv("KEEPALIVED_FIREWALL_CONFIG_MAP")
+	firewallFormat := os.Getenv("KEEPALIVED_FIREWALL_FORMAT")
+	recoverFromStatus := os.Getenv("KEEPALIVED_RECOVER_FROM_STATUS") == "true"
+	dryRun := os.Getenv("KEEPALIVED_DRY_RUN") == "true"
+	debugAddress := os.Getenv("KEEPALIVED_DEBUG_ADDRESS")
+	webhookAddress := os.Getenv("KEEPALIVED_WEBHOOK_ADDRESS")
+	webhookTLSCertFile := os.Getenv("KEEPALIVED_WEBHOOK_TLS_CERT_FILE")
+	webhookTLSKeyFile := os.Getenv("KEEPALIVED_WEBHOOK_TLS_KEY_FILE")
+	feedAddress := os.Getenv("KEEPALIVED_FEED_ADDRESS")
+	feedTLSCertFile := os.Getenv("KEEPALIVED_FEED_TLS_CERT_FILE")
+	feedTLSKeyFile := os.Getenv("KEEPALIVED_FEED_TLS_KEY_FILE")
+	feedTLSClientCAFile := os.Getenv("KEEPALIVED_FEED_TLS_CLIENT_CA_FILE")
+	refreshInterval, err := durationFromEnv("KEEPALIVED_REFRESH_INTERVAL", defaultRefreshInterval)
+	if err != nil {
+		return nil, err
+	}
+	backupSpec := os.Getenv("KEEPALIVED_BACKUP")
+	backupInterval, err := durationFromEnv("KEEPALIVED_BACKUP_INTERVAL", defaultBackupInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	if format != "" {
+		if err := validateConfigFormat(format); err != nil {
+			return nil, fmt.Errorf("invalid KEEPALIVED_CONFIG_FORMAT: %s", err.Error())
+		}
+	}
+
+	switch firewallFormat {
+	case "":
+		firewallFormat = firewallFormatNftables
+	case firewallFormatNftables, firewallFormatIptables:
+	default:
+		return nil, fmt.Errorf("invalid KEEPALIVED_FIREWALL_FORMAT '%s': must be one of %s, %s", firewallFormat, firewallFormatNftables, firewallFormatIptables)
+	}
+
+	switch driftPolicy {
+	case "":
+		driftPolicy = driftPolicyRemove
+	case driftPolicyRemove, driftPolicyAdopt:
+	default:
+		return nil, fmt.Errorf("invalid KEEPALIVED_DRIFT_POLICY '%s': must be one of %s, %s", driftPolicy, driftPolicyRemove, driftPolicyAdopt)
+	}
 
 	cfg, err := rest.InClusterConfig()
 
@@ -43,7 +127,204 @@ func newKeepalivedCloudProvider(io.Reader) (cloudprovider.Interface, error) {
 		return nil, fmt.Errorf("error creating kubernetes client: %s", err.Error())
 	}
 
-	return &KeepalivedCloudProvider{NewKeepalivedLoadBalancer(cl, ns, cm, cidr, fm)}, nil
+	var topo topology
+	if topologySource != "" {
+		if topo, err = newTopology(topologySource); err != nil {
+			return nil, err
+		}
+	}
+
+	lb := NewKeepalivedLoadBalancer(cl, newEventRecorder(cl), ns, cm, cidr, fm, format)
+	lb.topology = topo
+	lb.dryRun = dryRun
+	lb.dryRunLog = &dryRunLog{}
+
+	if len(cc.Pools) > 0 {
+		if cidr != "" {
+			glog.Warningf("ignoring KEEPALIVED_SERVICE_CIDR %s, as pools are configured in the cloud config", cidr)
+		}
+		lb.pools = cc.Pools
+	} else if err := validatePools(lb.pools); err != nil {
+		return nil, fmt.Errorf("invalid KEEPALIVED_SERVICE_CIDR: %s", err.Error())
+	}
+
+	if len(lb.pools) == 0 {
+		return nil, fmt.Errorf("no ip pools configured: set KEEPALIVED_SERVICE_CIDR or pools in the cloud config")
+	}
+
+	for _, p := range lb.pools {
+		if p.Zone != "" && topo == nil {
+			return nil, fmt.Errorf("pool '%s' is restricted to a zone, but KEEPALIVED_TOPOLOGY is not set", p.Name)
+		}
+	}
+
+	if err := validateQuotas(cc.Quotas, lb.pools); err != nil {
+		return nil, err
+	}
+	lb.quotas = cc.Quotas
+	lb.healthCheckScripts = cc.HealthCheckScripts
+	observeQuotas(lb.quotas)
+
+	if firewallConfigMap != "" {
+		parts := strings.Split(firewallConfigMap, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid KEEPALIVED_FIREWALL_CONFIG_MAP '%s': expected <namespace>/<name>", firewallConfigMap)
+		}
+		lb.firewall = &firewall{cl, parts[0], parts[1], firewallFormat, dryRun}
+	}
+
+	if cc.HostnameTemplate != "" {
+		if lb.hostnameTemplate, err = parseHostnameTemplate(cc.HostnameTemplate); err != nil {
+			return nil, err
+		}
+	}
+	lb.restrictHostnames = cc.DNS != nil
+
+	var dnsQueue *notificationQueue
+	if len(cc.Notifications) > 0 || cc.DNS != nil {
+		lb.notifier = newNotifier()
+		for _, e := range cc.Notifications {
+			lb.notifier.add(newNotificationQueue(e, notificationInitialBackoff))
+		}
+		if cc.DNS != nil {
+			dnsQueue = newDNSQueue(newDNSPublisher(*cc.DNS), notificationInitialBackoff)
+			lb.notifier.add(dnsQueue)
+		}
+	}
+
+	if feedAddress != "" {
+		if feedTLSCertFile == "" || feedTLSKeyFile == "" || feedTLSClientCAFile == "" {
+			return nil, fmt.Errorf("KEEPALIVED_FEED_ADDRESS requires KEEPALIVED_FEED_TLS_CERT_FILE, KEEPALIVED_FEED_TLS_KEY_FILE and KEEPALIVED_FEED_TLS_CLIENT_CA_FILE")
+		}
+		lb.feed = newAllocationFeed()
+		server, err := newFeedServer(lb.feed, feedTLSCertFile, feedTLSKeyFile, feedTLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		lis, err := net.Listen("tcp", feedAddress)
+		if err != nil {
+			return nil, fmt.Errorf("error listening on KEEPALIVED_FEED_ADDRESS: %s", err.Error())
+		}
+
+		go func() {
+			glog.Fatalf("error serving allocation feed: %s", server.Serve(lis))
+		}()
+	}
+
+	if lb.notifier != nil || lb.feed != nil {
+		if refreshInterval <= 0 {
+			return nil, fmt.Errorf("invalid KEEPALIVED_REFRESH_INTERVAL '%s': must be positive", refreshInterval)
+		}
+		// publish the allocations before bootstrapping or recovering, so that
+		// the allocations they add are notified
+		if _, err := lb.refreshPublished(); err != nil {
+			glog.Errorf("error publishing existing allocations: %s", err.Error())
+		}
+		go lb.runRefresh(refreshInterval, wait.NeverStop)
+	}
+
+	// bootstrap first, so that the entries of a ConfigMap populated by hand
+	// are imported rather than replaced by recovering the missing annotation
+	if err := lb.bootstrap(); err != nil {
+		return nil, fmt.Errorf("error importing existing configmap entries: %s", err.Error())
+	}
+
+	if recoverFromStatus {
+		lb.recoverFromStatus = true
+		if _, err := lb.recoverFromServices(); err != nil {
+			return nil, fmt.Errorf("error recovering config from service status: %s", err.Error())
+		}
+	}
+
+	if dnsQueue != nil {
+		// publish the records of existing allocations, in case they were
+		// changed while the provider was not running
+		if cm, err := lb.getConfigMap(); err != nil {
+			glog.Errorf("error publishing dns records of existing allocations: %s", err.Error())
+		} else if cfg, err := configFrom(cm); err != nil {
+			glog.Errorf("error publishing dns records of existing allocations: %s", err.Error())
+		} else {
+			for _, n := range currentAllocations(cfg, time.Now()) {
+				dnsQueue.enqueue(n)
+			}
+		}
+	}
+
+	if gcInterval > 0 {
+		go newOrphanCollector(lb, gcGracePeriod, gcDryRun).Run(gcInterval, wait.NeverStop)
+	}
+
+	if driftInterval > 0 {
+		go newDriftReconciler(lb, driftPolicy).Run(driftInterval, wait.NeverStop)
+	}
+
+	if backupSpec != "" {
+		store, err := newStateStore(cl, backupSpec, format)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KEEPALIVED_BACKUP: %s", err.Error())
+		}
+		go newBackupper(lb, store).Run(backupInterval, wait.NeverStop)
+	}
+
+	if webhookAddress != "" {
+		if webhookTLSCertFile == "" || webhookTLSKeyFile == "" {
+			return nil, fmt.Errorf("KEEPALIVED_WEBHOOK_TLS_CERT_FILE and KEEPALIVED_WEBHOOK_TLS_KEY_FILE must be set to serve the admission webhook")
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/validate", newServiceWebhook(lb))
+		go func() {
+			glog.Fatalf("error serving admission webhook: %s", http.ListenAndServeTLS(webhookAddress, webhookTLSCertFile, webhookTLSKeyFile, mux))
+		}()
+	}
+
+	if debugAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/dry-run", lb.dryRunLog)
+		go func() {
+			glog.Fatalf("error serving debug endpoints: %s", http.ListenAndServe(debugAddress, mux))
+		}()
+	}
+
+	kcp := &KeepalivedCloudProvider{
+		lb:    lb,
+		zones: &zones{topo, cl, nodeName},
+	}
+
+	if inventorySource != "" {
+		inv, err := newInventory(cl, inventorySource)
+		if err != nil {
+			return nil, err
+		}
+		kcp.instances = &instances{inv}
+	}
+
+	if routesConfigMap != "" {
+		parts := strings.Split(routesConfigMap, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid KEEPALIVED_ROUTES_CONFIG_MAP '%s': expected <namespace>/<name>", routesConfigMap)
+		}
+		r := &routes{store: &configMapRouteStore{cl, parts[0], parts[1]}, dryRun: dryRun}
+		if routesFile != "" {
+			r.backend = newStaticRouteFile(cl, routesFile)
+		}
+		kcp.routes = r
+	}
+
+	return kcp, nil
+}
+
+// durationFromEnv parses the duration in the environment variable key,
+// returning def if it is not set.
+func durationFromEnv(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s '%s': %s", key, v, err.Error())
+	}
+	return d, nil
 }
 
 // LoadBalancer returns a loadbalancer interface. Also returns true if the interface is supported, false otherwise.
@@ -53,12 +334,12 @@ func (k *KeepalivedCloudProvider) LoadBalancer() (cloudprovider.LoadBalancer, bo
 
 // Instances returns an instances interface. Also returns true if the interface is supported, false otherwise.
 func (k *KeepalivedCloudProvider) Instances() (cloudprovider.Instances, bool) {
-	return nil, false
+	return k.instances, k.instances != nil
 }
 
 // Zones returns a zones interface. Also returns true if the interface is supported, false otherwise.
 func (k *KeepalivedCloudProvider) Zones() (cloudprovider.Zones, bool) {
-	return zones{}, true
+	return k.zones, true
 }
 
 // Clusters returns a clusters interface.  Also returns true if the interface is supported, false otherwise.
@@ -68,7 +349,7 @@ func (k *KeepalivedCloudProvider) Clusters() (cloudprovider.Clusters, bool) {
 
 // Routes returns a routes interface along with whether the interface is supported.
 func (k *KeepalivedCloudProvider) Routes() (cloudprovider.Routes, bool) {
-	return nil, false
+	return k.routes, k.routes != nil
 }
 
 // ProviderName returns the cloud provider ID.
@@ -80,9 +361,3 @@ func (k *KeepalivedCloudProvider) ProviderName() string {
 func (k *KeepalivedCloudProvider) ScrubDNS(nameservers, searches []string) (nsOut, srchOut []string) {
 	return nil, nil
 }
-
-type zones struct{}
-
-func (z zones) GetZone() (cloudprovider.Zone, error) {
-	return cloudprovider.Zone{FailureDomain: "FailureDomain1", Region: "Region1"}, nil
-}
@@ -2,6 +2,7 @@ package keepalivedcp
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 
@@ -11,9 +12,26 @@ import (
 )
 
 type config struct {
+	// Version is the version of the config's schema, see decodeConfig
+	Version  int             `json:"version"`
 	Services []serviceConfig `json:"services"`
+	// Nodes is the list of node addresses that were passed in the most recent
+	// sync, used as the real servers when rendering keepalived.conf
+	Nodes []string `json:"nodes,omitempty"`
+	// Reserved are IPs that have been reserved by hand, and are never
+	// allocated to a service
+	Reserved []string `json:"reserved,omitempty"`
+	// Unmanaged are the kube-keepalived-vip ConfigMap entries, keyed by IP,
+	// that were imported by bootstrap but are not for a LoadBalancer service.
+	// Their IPs are also reserved, and they are written back unchanged
+	// whenever the ConfigMap data is rendered in the vip format.
+	Unmanaged map[string]string `json:"unmanaged,omitempty"`
 }
 
+// errPoolExhausted is returned by allocateIP when every IP in the CIDR is in
+// use or reserved.
+var errPoolExhausted = errors.New("ip cidr pool exhausted. increase size of cidr or remove some loadbalancers")
+
 func (c *config) allocateIP(cidr string) (string, error) {
 	possible, err := Hosts(cidr)
 	if err != nil {
@@ -22,6 +40,9 @@ func (c *config) allocateIP(cidr string) (string, error) {
 
 Outer:
 	for _, ip := range possible {
+		if c.isReserved(ip) {
+			continue
+		}
 		for _, svc := range c.Services {
 			// if this 'ip' candidate is already in use,
 			// break the inner loop to move onto the next IP address
@@ -34,10 +55,21 @@ Outer:
 		return ip, nil
 	}
 
-	return "", fmt.Errorf("ip cidr pool exhausted. increase size of cidr or remove some loadbalancers")
+	return "", errPoolExhausted
+}
+
+// isReserved returns whether ip has been reserved by hand.
+func (c *config) isReserved(ip string) bool {
+	for _, r := range c.Reserved {
+		if r == ip {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *config) encode() ([]byte, error) {
+	c.Version = currentConfigVersion
 	return json.Marshal(c)
 }
 
@@ -64,40 +96,99 @@ func (c *config) deleteService(cfg serviceConfig) {
 	}
 }
 
+// serviceByUID returns the service in the config with the given uid, and
+// whether it was found.
+func (c *config) serviceByUID(uid string) (serviceConfig, bool) {
+	for _, s := range c.Services {
+		if s.UID == uid {
+			return s, true
+		}
+	}
+	return serviceConfig{}, false
+}
+
 type serviceConfig struct {
 	UID              string `json:"uid"`
 	IP               string `json:"ip"`
 	ServiceNamespace string `json:"serviceNamespace"`
 	ServiceName      string `json:"serviceName"`
 	ForwardMethod    string `json:"forwardMethod,omitempty"`
+	// Pool is the name of the pool the IP was allocated from, and Zone the
+	// zone that the pool is restricted to
+	Pool string `json:"pool,omitempty"`
+	Zone string `json:"zone,omitempty"`
+	// Hostname is the DNS name of the VIP, from the service's annotation or
+	// the hostname template
+	Hostname string `json:"hostname,omitempty"`
+
+	Scheduler              string `json:"scheduler,omitempty"`
+	PersistenceTimeout     int    `json:"persistenceTimeout,omitempty"`
+	PersistenceGranularity string `json:"persistenceGranularity,omitempty"`
+	// ProxyProtocol is the version of the PROXY protocol, v1 or v2, to send
+	// to the real servers, or empty to forward connections with IPVS
+	ProxyProtocol string `json:"proxyProtocol,omitempty"`
+	// SNIHostnames are the hostnames of TLS connections to route to the
+	// service, when it shares its VIP and ports with other services
+	SNIHostnames []string `json:"sniHostnames,omitempty"`
+
+	Ports []servicePort `json:"ports,omitempty"`
+
+	// HealthCheck is the health check to perform against real servers, or
+	// nil to use the default TCP connect check
+	HealthCheck *healthCheck `json:"healthCheck,omitempty"`
+	// SourceRanges are the CIDRs that clients must be in to connect to the
+	// VIP, or empty to allow all clients
+	SourceRanges []string `json:"sourceRanges,omitempty"`
+}
+
+type servicePort struct {
+	Name     string `json:"name,omitempty"`
+	Protocol string `json:"protocol"`
+	Port     int32  `json:"port"`
+	NodePort int32  `json:"nodePort"`
 }
 
 func configFrom(cm *v1.ConfigMap) (*config, error) {
-	cfg := config{}
 	if c, ok := cm.Annotations[configMapAnnotationKey]; ok {
-		err := json.Unmarshal([]byte(c), &cfg)
+		cfg, err := decodeConfig([]byte(c))
 
 		if err != nil {
 			return nil, fmt.Errorf("error getting cloud provider config from annotation: %s", err.Error())
 		}
+
+		return cfg, nil
 	}
-	return &cfg, nil
+	return &config{Version: currentConfigVersion}, nil
 }
 
 func (c *config) toConfigMapData() map[string]string {
-	d := make(map[string]string, len(c.Services))
+	d := make(map[string]string, len(c.Services)+len(c.Unmanaged))
+	for ip, v := range c.Unmanaged {
+		d[ip] = v
+	}
 	for _, s := range c.Services {
-
-		if s.ForwardMethod != "" {
-			d[s.IP] = s.ServiceNamespace + "/" + s.ServiceName + ":" + s.ForwardMethod
-		} else {
-			d[s.IP] = s.ServiceNamespace + "/" + s.ServiceName
-		}
+		d[s.IP] = s.configMapValue()
 	}
 
 	return d
 }
 
+// configMapValue returns the kube-keepalived-vip ConfigMap value for s, in
+// the format namespace/name[:method]. kube-keepalived-vip cannot parse any
+// other options, so services that need them are rejected by serviceConfigFor
+// in this format, or warned that they are not applied by syncLoadBalancer.
+func (s serviceConfig) configMapValue() string {
+	v := s.ServiceNamespace + "/" + s.ServiceName
+	if s.ProxyProtocol != "" {
+		// kube-keepalived-vip forwards with haproxy, which sends the PROXY
+		// protocol v1 header, instead of IPVS
+		v += ":" + forwardMethodProxy
+	} else if s.ForwardMethod != "" {
+		v += ":" + s.ForwardMethod
+	}
+	return v
+}
+
 // from: https://gist.github.com/kotakanbe/d3059af990252ba89a82
 func Hosts(cidr string) ([]string, error) {
 	ip, ipnet, err := net.ParseCIDR(cidr)
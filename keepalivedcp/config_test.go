@@ -33,6 +33,20 @@ func TestAllocateIP(t *testing.T) {
 			cidr:       "10.0.0.0/8",
 			expectedIP: "10.0.0.2",
 		},
+		{
+			name: "allocate ip address skipping reserved addresses",
+			config: config{
+				Services: []serviceConfig{
+					{
+						UID: "a",
+						IP:  "10.0.0.1",
+					},
+				},
+				Reserved: []string{"10.0.0.2"},
+			},
+			cidr:       "10.0.0.0/8",
+			expectedIP: "10.0.0.3",
+		},
 	}
 
 	for _, test := range tests {
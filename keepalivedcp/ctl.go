@@ -0,0 +1,458 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const ctlUsage = `Inspect and manage the VIPs allocated by keepalived-cloud-provider.
+
+Usage:
+  keepalived-cloud-provider ctl [flags] <command> [args]
+
+Commands:
+  list                            list allocations and pool usage
+  get <namespace>/<name>          show the VIP allocated to a service
+  reserve <ip>                    reserve an IP so it is never allocated
+  release <ip>                    release an IP reserved or allocated to a service
+  validate                        check the allocations for problems
+  migrate <from> <to>             copy the allocations between storage backends, where
+                                  each is configmap:<namespace>/<name>, secret:<namespace>/<name>
+                                  or file:<path>
+  restore <from>                  restore the allocations from a snapshot, matching services
+                                  by namespace/name and keeping newer allocations
+  recover                         rebuild missing or corrupt allocations from the ingress IPs
+                                  in the status of services
+
+Flags:
+`
+
+// RunCtl runs the ctl subcommand with args, writing its output to out.
+func RunCtl(args []string, out io.Writer) error {
+	fs := pflag.NewFlagSet("ctl", pflag.ContinueOnError)
+	kubeconfig := fs.String("kubeconfig", os.Getenv("KUBECONFIG"), "Path to a kubeconfig file")
+	namespace := fs.String("namespace", os.Getenv("KEEPALIVED_NAMESPACE"), "Namespace of the keepalived ConfigMap")
+	configMap := fs.String("configmap", os.Getenv("KEEPALIVED_CONFIG_MAP"), "Name of the keepalived ConfigMap")
+	serviceCidr := fs.String("service-cidr", os.Getenv("KEEPALIVED_SERVICE_CIDR"), "CIDR to allocate VIPs from, if no pools are configured")
+	configFormat := fs.String("config-format", os.Getenv("KEEPALIVED_CONFIG_FORMAT"), "Format of the keepalived ConfigMap data")
+	cloudConfigFile := fs.String("cloud-config", "", "Path to the cloud provider configuration file")
+	force := fs.Bool("force", false, "Overwrite existing allocations in the destination of migrate, or replace the allocations of services in the snapshot on restore")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, ctlUsage)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no command given")
+	}
+
+	if *configFormat != "" {
+		if err := validateConfigFormat(*configFormat); err != nil {
+			return err
+		}
+	}
+
+	restConfig, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		return fmt.Errorf("error creating kubernetes client config: %s", err.Error())
+	}
+	cl, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("error creating kubernetes client: %s", err.Error())
+	}
+
+	k := NewKeepalivedLoadBalancer(cl, nil, *namespace, *configMap, *serviceCidr, "", *configFormat)
+	if *cloudConfigFile != "" {
+		f, err := os.Open(*cloudConfigFile)
+		if err != nil {
+			return fmt.Errorf("error opening cloud config: %s", err.Error())
+		}
+		defer f.Close()
+		cc, err := readCloudConfig(f)
+		if err != nil {
+			return err
+		}
+		if len(cc.Pools) > 0 {
+			k.pools = cc.Pools
+		}
+		k.healthCheckScripts = cc.HealthCheckScripts
+		if cc.HostnameTemplate != "" {
+			if k.hostnameTemplate, err = parseHostnameTemplate(cc.HostnameTemplate); err != nil {
+				return err
+			}
+		}
+	}
+
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "list":
+		return k.ctlList(out)
+	case "get":
+		if len(cmdArgs) != 1 {
+			return fmt.Errorf("usage: get <namespace>/<name>")
+		}
+		return k.ctlGet(out, cmdArgs[0])
+	case "reserve":
+		if len(cmdArgs) != 1 {
+			return fmt.Errorf("usage: reserve <ip>")
+		}
+		return k.ctlReserve(out, cmdArgs[0])
+	case "release":
+		if len(cmdArgs) != 1 {
+			return fmt.Errorf("usage: release <ip>")
+		}
+		return k.ctlRelease(out, cmdArgs[0])
+	case "validate":
+		return k.ctlValidate(out)
+	case "migrate":
+		if len(cmdArgs) != 2 {
+			return fmt.Errorf("usage: migrate <from> <to>")
+		}
+		return ctlMigrate(out, cl, *configFormat, cmdArgs[0], cmdArgs[1], *force)
+	case "restore":
+		if len(cmdArgs) != 1 {
+			return fmt.Errorf("usage: restore <from>")
+		}
+		return k.ctlRestore(out, cmdArgs[0], *force)
+	case "recover":
+		recovered, err := k.recoverFromServices()
+		if err != nil {
+			return err
+		}
+		if !recovered {
+			fmt.Fprintln(out, "config is valid, nothing to recover")
+			return nil
+		}
+		return k.ctlList(out)
+	}
+	return fmt.Errorf("unknown command '%s'", cmd)
+}
+
+func (k *KeepalivedLoadBalancer) ctlList(out io.Writer) error {
+	cm, err := k.getConfigMap()
+	if err != nil {
+		return err
+	}
+	cfg, err := configFrom(cm)
+	if err != nil {
+		return err
+	}
+
+	writeAllocations(out, cfg)
+	fmt.Fprintln(out)
+	return writePoolUsage(out, cfg, k.pools)
+}
+
+func writeAllocations(out io.Writer, cfg *config) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tUID\tIP\tPOOL\tZONE")
+	svcs := make([]serviceConfig, len(cfg.Services))
+	copy(svcs, cfg.Services)
+	sort.Sort(servicesByName(svcs))
+	for _, s := range svcs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.ServiceNamespace, s.ServiceName, s.UID, s.IP, orNone(s.Pool), orNone(s.Zone))
+	}
+	for _, ip := range cfg.Reserved {
+		fmt.Fprintf(w, "<reserved>\t\t\t%s\t\t\n", ip)
+	}
+	w.Flush()
+}
+
+func writePoolUsage(out io.Writer, cfg *config, pools []pool) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "POOL\tCIDR\tZONE\tUSED\tSIZE")
+	for i := range pools {
+		p := &pools[i]
+		hosts, err := Hosts(p.CIDR)
+		if err != nil {
+			return fmt.Errorf("invalid cidr '%s' for pool '%s': %s", p.CIDR, p.Name, err.Error())
+		}
+		used := 0
+		for _, s := range cfg.Services {
+			if p.contains(s.IP) {
+				used++
+			}
+		}
+		for _, ip := range cfg.Reserved {
+			if p.contains(ip) {
+				used++
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", p.Name, p.CIDR, orNone(p.Zone), used, len(hosts))
+	}
+	return w.Flush()
+}
+
+func (k *KeepalivedLoadBalancer) ctlGet(out io.Writer, service string) error {
+	ns, name, _, err := parseConfigMapValue(service)
+	if err != nil {
+		return err
+	}
+
+	cm, err := k.getConfigMap()
+	if err != nil {
+		return err
+	}
+	cfg, err := configFrom(cm)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range cfg.Services {
+		if s.ServiceNamespace == ns && s.ServiceName == name {
+			fmt.Fprintln(out, s.IP)
+			return nil
+		}
+	}
+	return fmt.Errorf("no VIP allocated to service %s/%s", ns, name)
+}
+
+func (k *KeepalivedLoadBalancer) ctlReserve(out io.Writer, ip string) error {
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid ip '%s'", ip)
+	}
+
+	cm, err := k.getConfigMap()
+	if err != nil {
+		return err
+	}
+	cfg, err := configFrom(cm)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range cfg.Services {
+		if s.IP == ip {
+			return fmt.Errorf("ip %s is allocated to service %s/%s", ip, s.ServiceNamespace, s.ServiceName)
+		}
+	}
+	if cfg.isReserved(ip) {
+		return fmt.Errorf("ip %s is already reserved", ip)
+	}
+
+	cfg.Reserved = append(cfg.Reserved, ip)
+	if err := k.updateConfigMap(cm, cfg); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "reserved %s\n", ip)
+	return nil
+}
+
+func (k *KeepalivedLoadBalancer) ctlRelease(out io.Writer, ip string) error {
+	cm, err := k.getConfigMap()
+	if err != nil {
+		return err
+	}
+	cfg, err := configFrom(cm)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range cfg.Reserved {
+		if r == ip {
+			cfg.Reserved = append(cfg.Reserved[:i], cfg.Reserved[i+1:]...)
+			if _, ok := cfg.Unmanaged[ip]; ok {
+				delete(cfg.Unmanaged, ip)
+				delete(cm.Data, ip)
+			}
+			if err := k.updateConfigMap(cm, cfg); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "released reserved ip %s\n", ip)
+			return nil
+		}
+	}
+
+	for _, s := range cfg.Services {
+		if s.IP == ip {
+			if err := k.releaseService(cm, cfg, s); err != nil {
+				return err
+			}
+			if err := k.updateConfigMap(cm, cfg); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "released ip %s from service %s/%s\n", ip, s.ServiceNamespace, s.ServiceName)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("ip %s is not reserved or allocated", ip)
+}
+
+func (k *KeepalivedLoadBalancer) ctlValidate(out io.Writer) error {
+	cm, err := k.getConfigMap()
+	if err != nil {
+		return err
+	}
+	cfg, err := configFrom(cm)
+	if err != nil {
+		return err
+	}
+
+	problems := validateConfig(cfg, k.pools)
+	data, err := k.configMapData(cfg)
+	if err != nil {
+		return err
+	}
+	for _, msg := range diffData(cm.Data, data) {
+		problems = append(problems, "configmap data has drifted from config: "+msg)
+	}
+
+	svcs, err := k.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing services: %s", err.Error())
+	}
+	live := make(map[string]bool, len(svcs.Items))
+	for _, svc := range svcs.Items {
+		if svc.Spec.Type == apiv1.ServiceTypeLoadBalancer {
+			live[string(svc.UID)] = true
+		}
+	}
+	for _, s := range cfg.Services {
+		if !live[s.UID] {
+			problems = append(problems, fmt.Sprintf("service %s/%s (%s) allocated %s no longer exists or is no longer of type LoadBalancer", s.ServiceNamespace, s.ServiceName, s.UID, s.IP))
+		}
+	}
+
+	if len(problems) == 0 {
+		fmt.Fprintln(out, "ok")
+		return nil
+	}
+	for _, p := range problems {
+		fmt.Fprintln(out, p)
+	}
+	return fmt.Errorf("found %d problems", len(problems))
+}
+
+func ctlMigrate(out io.Writer, kubeClient kubernetes.Interface, configFormat, fromSpec, toSpec string, force bool) error {
+	from, err := newStateStore(kubeClient, fromSpec, configFormat)
+	if err != nil {
+		return err
+	}
+	to, err := newStateStore(kubeClient, toSpec, configFormat)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := migrateState(from, to, force)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "migrated %d allocations and %d reserved ips from %s to %s (config version %d)\n", len(cfg.Services), len(cfg.Reserved), from, to, cfg.Version)
+	return nil
+}
+
+func (k *KeepalivedLoadBalancer) ctlRestore(out io.Writer, fromSpec string, force bool) error {
+	from, err := newStateStore(k.kubeClient, fromSpec, k.configFormat)
+	if err != nil {
+		return err
+	}
+	to := &configMapStateStore{k}
+
+	snapshot, err := from.load()
+	if err != nil {
+		return fmt.Errorf("error loading snapshot from %s: %s", from, err.Error())
+	}
+
+	existing, err := to.load()
+	if err != nil {
+		return err
+	}
+
+	restored, changes, err := restoreConfig(snapshot, existing, k.lookupService, force)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		fmt.Fprintln(out, c)
+	}
+
+	if err := to.save(restored); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "restored %d of %d allocations from %s to %s\n", len(restored.Services), len(snapshot.Services), from, to)
+	return nil
+}
+
+// validateConfig returns a description of each problem with the allocations
+// in cfg: invalid or duplicate IPs, duplicate UIDs, and IPs outside of every
+// pool.
+func validateConfig(cfg *config, pools []pool) []string {
+	var problems []string
+	ips := map[string]string{}
+	uids := map[string]bool{}
+
+	owner := func(ip, who string) {
+		if other, ok := ips[ip]; ok {
+			problems = append(problems, fmt.Sprintf("ip %s is allocated to both %s and %s", ip, other, who))
+			return
+		}
+		ips[ip] = who
+	}
+
+	for _, s := range cfg.Services {
+		who := s.ServiceNamespace + "/" + s.ServiceName
+		if net.ParseIP(s.IP) == nil {
+			problems = append(problems, fmt.Sprintf("service %s has invalid ip '%s'", who, s.IP))
+			continue
+		}
+		if uids[s.UID] {
+			problems = append(problems, fmt.Sprintf("service %s has more than one allocation for uid %s", who, s.UID))
+		}
+		uids[s.UID] = true
+		owner(s.IP, who)
+	}
+
+	for _, ip := range cfg.Reserved {
+		if net.ParseIP(ip) == nil {
+			problems = append(problems, fmt.Sprintf("invalid reserved ip '%s'", ip))
+			continue
+		}
+		owner(ip, "<reserved>")
+	}
+
+	for _, s := range cfg.Services {
+		inPool := false
+		for i := range pools {
+			if pools[i].contains(s.IP) {
+				inPool = true
+				break
+			}
+		}
+		if !inPool && net.ParseIP(s.IP) != nil {
+			problems = append(problems, fmt.Sprintf("warning: service %s/%s ip %s is not in any pool", s.ServiceNamespace, s.ServiceName, s.IP))
+		}
+	}
+
+	return problems
+}
+
+type servicesByName []serviceConfig
+
+func (s servicesByName) Len() int      { return len(s) }
+func (s servicesByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s servicesByName) Less(i, j int) bool {
+	return s[i].ServiceNamespace+"/"+s[i].ServiceName < s[j].ServiceNamespace+"/"+s[j].ServiceName
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
@@ -0,0 +1,60 @@
+package keepalivedcp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	cfg := &config{
+		Services: []serviceConfig{
+			{UID: "a", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "a"},
+			{UID: "b", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "b"},
+			{UID: "b", IP: "10.0.0.2", ServiceNamespace: "default", ServiceName: "b"},
+			{UID: "c", IP: "192.168.0.1", ServiceNamespace: "default", ServiceName: "c"},
+			{UID: "d", IP: "bad", ServiceNamespace: "default", ServiceName: "d"},
+		},
+		Reserved: []string{"10.0.0.2"},
+	}
+	pools := []pool{{Name: defaultPoolName, CIDR: "10.0.0.0/24"}}
+
+	expected := []string{
+		"ip 10.0.0.1 is allocated to both default/a and default/b",
+		"service default/b has more than one allocation for uid b",
+		"service default/d has invalid ip 'bad'",
+		"ip 10.0.0.2 is allocated to both default/b and <reserved>",
+		"warning: service default/c ip 192.168.0.1 is not in any pool",
+	}
+
+	if problems := validateConfig(cfg, pools); !reflect.DeepEqual(problems, expected) {
+		t.Errorf("expected problems:\n%v\nbut got:\n%v", expected, problems)
+	}
+}
+
+func TestWritePoolUsage(t *testing.T) {
+	cfg := &config{
+		Services: []serviceConfig{
+			{UID: "a", IP: "10.0.0.1"},
+			{UID: "b", IP: "10.0.1.1"},
+		},
+		Reserved: []string{"10.0.0.2"},
+	}
+	pools := []pool{
+		{Name: "rack-1", CIDR: "10.0.0.0/29", Zone: "rack-1"},
+		{Name: "rack-2", CIDR: "10.0.1.0/30"},
+	}
+
+	expected := `POOL    CIDR         ZONE    USED  SIZE
+rack-1  10.0.0.0/29  rack-1  2     6
+rack-2  10.0.1.0/30  <none>  1     2
+`
+
+	var b bytes.Buffer
+	if err := writePoolUsage(&b, cfg, pools); err != nil {
+		t.Fatalf("got error: %s", err.Error())
+	}
+	if b.String() != expected {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expected, b.String())
+	}
+}
@@ -0,0 +1,241 @@
+package keepalivedcp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDNSTTL     = 300
+	defaultDNSTimeout = 5 * time.Second
+	// tsigFudge is the number of seconds of clock skew the server permits
+	// between it and the provider
+	tsigFudge = 300
+)
+
+// tsigAlgorithms are the supported TSIG algorithms, by their name in TSIG
+// records.
+var tsigAlgorithms = map[string]bool{
+	dns.HmacSHA1:   true,
+	dns.HmacSHA256: true,
+	dns.HmacSHA512: true,
+}
+
+// dnsConfig configures publishing of DNS records for VIPs, with RFC 2136
+// dynamic updates.
+type dnsConfig struct {
+	// Server is the address of the primary server of the zones, as host or
+	// host:port
+	Server string `json:"server"`
+	// Zone is the zone A and AAAA records are added to
+	Zone string `json:"zone"`
+	// ReverseZones are the in-addr.arpa and ip6.arpa zones PTR records are
+	// added to. PTR records are only published for VIPs in one of them.
+	ReverseZones []string `json:"reverseZones,omitempty"`
+	TTL          uint32   `json:"ttl,omitempty"`
+	// TSIG is the key updates are signed with, or nil to send them unsigned
+	TSIG *tsigKey `json:"tsig,omitempty"`
+}
+
+type tsigKey struct {
+	Name string `json:"name"`
+	// Algorithm is one of hmac-sha1, hmac-sha256 or hmac-sha512, and
+	// defaults to hmac-sha256
+	Algorithm string `json:"algorithm,omitempty"`
+	// Secret is the base64 encoded key
+	Secret string `json:"secret"`
+}
+
+func validateDNSConfig(c *dnsConfig) error {
+	if c.Server == "" {
+		return fmt.Errorf("dns server must be set")
+	}
+	if !validHostname(canonicalZone(c.Zone)) {
+		return fmt.Errorf("invalid dns zone '%s'", c.Zone)
+	}
+	for _, z := range c.ReverseZones {
+		z = canonicalZone(z)
+		if !validHostname(z) || !(strings.HasSuffix(z, ".in-addr.arpa") || strings.HasSuffix(z, ".ip6.arpa")) {
+			return fmt.Errorf("invalid dns reverse zone '%s': must be within in-addr.arpa or ip6.arpa", z)
+		}
+	}
+	if c.TSIG != nil {
+		if !validHostname(canonicalZone(c.TSIG.Name)) {
+			return fmt.Errorf("invalid tsig key name '%s'", c.TSIG.Name)
+		}
+		if !tsigAlgorithms[c.TSIG.algorithm()] {
+			return fmt.Errorf("unsupported tsig algorithm '%s': must be one of hmac-sha1, hmac-sha256, hmac-sha512", c.TSIG.Algorithm)
+		}
+		if _, err := base64.StdEncoding.DecodeString(c.TSIG.Secret); err != nil || c.TSIG.Secret == "" {
+			return fmt.Errorf("invalid tsig secret for key '%s': must be base64 encoded", c.TSIG.Name)
+		}
+	}
+	return nil
+}
+
+func (t *tsigKey) algorithm() string {
+	if t.Algorithm == "" {
+		return dns.HmacSHA256
+	}
+	return strings.ToLower(strings.TrimSuffix(t.Algorithm, ".")) + "."
+}
+
+// canonicalZone returns zone in lower case without a trailing dot.
+func canonicalZone(zone string) string {
+	return strings.ToLower(strings.TrimSuffix(zone, "."))
+}
+
+// dnsPublisher keeps the records of VIPs up to date by sending dynamic
+// updates to the primary server of their zones.
+type dnsPublisher struct {
+	config  dnsConfig
+	server  string
+	timeout time.Duration
+	now     func() time.Time
+}
+
+func newDNSPublisher(c dnsConfig) *dnsPublisher {
+	server := c.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	c.Zone = canonicalZone(c.Zone)
+	for i, z := range c.ReverseZones {
+		c.ReverseZones[i] = canonicalZone(z)
+	}
+	if c.TTL == 0 {
+		c.TTL = defaultDNSTTL
+	}
+	return &dnsPublisher{config: c, server: server, timeout: defaultDNSTimeout, now: time.Now}
+}
+
+// newDNSQueue returns a queue that publishes the records of allocation
+// changes with p.
+func newDNSQueue(p *dnsPublisher, backoff time.Duration) *notificationQueue {
+	return newDeliveryQueue("dns server "+p.server, nil, 0, backoff, p.publish)
+}
+
+// publish updates the records of the VIP in nt. Adding a record that already
+// exists, or deleting one that does not, succeeds, so a notification can be
+// published again safely.
+func (p *dnsPublisher) publish(nt notification) error {
+	switch nt.Event {
+	case notificationAllocate:
+		return p.update(nt.Hostname, nt.IP, false)
+	case notificationRelease:
+		return p.update(nt.Hostname, nt.IP, true)
+	case notificationReallocate, notificationRename:
+		if err := p.update(nt.PreviousHostname, nt.PreviousIP, true); err != nil {
+			return err
+		}
+		return p.update(nt.Hostname, nt.IP, false)
+	}
+	return nil
+}
+
+// update adds, or deletes, the address record of hostname and the PTR
+// record of ip.
+func (p *dnsPublisher) update(hostname, ipStr string, delete bool) error {
+	ip := net.ParseIP(ipStr)
+	if hostname == "" || ip == nil {
+		return nil
+	}
+
+	if inZone(hostname, p.config.Zone) {
+		hdr := dns.RR_Header{Name: dns.Fqdn(hostname), Class: dns.ClassINET, Ttl: p.config.TTL}
+		var rr dns.RR
+		if ip4 := ip.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			rr = &dns.A{Hdr: hdr, A: ip4}
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			rr = &dns.AAAA{Hdr: hdr, AAAA: ip.To16()}
+		}
+		if err := p.send(p.config.Zone, rr, delete); err != nil {
+			return fmt.Errorf("error updating %s in zone %s: %s", hostname, p.config.Zone, err.Error())
+		}
+	} else {
+		glog.Warningf("not publishing dns record for '%s': not in zone %s", hostname, p.config.Zone)
+	}
+
+	name := reverseName(ip)
+	for _, z := range p.config.ReverseZones {
+		if !inZone(name, z) {
+			continue
+		}
+		rr := &dns.PTR{
+			Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: p.config.TTL},
+			Ptr: dns.Fqdn(hostname),
+		}
+		if err := p.send(z, rr, delete); err != nil {
+			return fmt.Errorf("error updating %s in zone %s: %s", name, z, err.Error())
+		}
+		break
+	}
+	return nil
+}
+
+// send sends an update adding rr to, or deleting it from, zone. Updates
+// are signed if a TSIG key is configured, in which case the response must be
+// signed with the same key.
+func (p *dnsPublisher) send(zone string, rr dns.RR, delete bool) error {
+	m := &dns.Msg{}
+	m.SetUpdate(dns.Fqdn(zone))
+	if delete {
+		m.Remove([]dns.RR{rr})
+	} else {
+		m.Insert([]dns.RR{rr})
+	}
+
+	client := &dns.Client{Timeout: p.timeout}
+	if key := p.config.TSIG; key != nil {
+		name := dns.Fqdn(canonicalZone(key.Name))
+		client.TsigSecret = map[string]string{name: key.Secret}
+		m.SetTsig(name, key.algorithm(), tsigFudge, p.now().Unix())
+	}
+
+	r, _, err := client.Exchange(m, p.server)
+	if err == dns.ErrTruncated || (err == nil && r.Truncated) {
+		client.Net = "tcp"
+		r, _, err = client.Exchange(m, p.server)
+	}
+	if err != nil {
+		return err
+	}
+	if p.config.TSIG != nil && r.IsTsig() == nil {
+		return fmt.Errorf("unsigned response from dns server")
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		rcode, ok := dns.RcodeToString[r.Rcode]
+		if !ok {
+			rcode = fmt.Sprintf("RCODE%d", r.Rcode)
+		}
+		return fmt.Errorf("dns server responded %s", rcode)
+	}
+	return nil
+}
+
+// inZone returns true if name is zone, or a name within it.
+func inZone(name, zone string) bool {
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of ip.
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	const hex = "0123456789abcdef"
+	ip6 := ip.To16()
+	labels := make([]string, 0, 34)
+	for i := len(ip6) - 1; i >= 0; i-- {
+		labels = append(labels, string(hex[ip6[i]&0xf]), string(hex[ip6[i]>>4]))
+	}
+	return strings.Join(append(labels, "ip6", "arpa"), ".")
+}
@@ -0,0 +1,237 @@
+package keepalivedcp
+
+import (
+	"encoding/base64"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// receivedUpdate is an update received by the test DNS server.
+type receivedUpdate struct {
+	zone   string
+	name   string
+	rrtype uint16
+	class  uint16
+	ttl    uint32
+	rdata  string
+}
+
+// testDNSServer stands in for the primary server of a zone, answering each
+// update with rcode, and recording the updates it receives. If the server has
+// a key, updates must be signed with it, and responses are signed with
+// signingKey.
+type testDNSServer struct {
+	t          *testing.T
+	server     *dns.Server
+	key        *tsigKey
+	signingKey *tsigKey
+	rcode      int
+	updates    chan receivedUpdate
+}
+
+func newTestDNSServer(t *testing.T, key, signingKey *tsigKey, rcode int) *testDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err.Error())
+	}
+	s := &testDNSServer{t: t, key: key, signingKey: signingKey, rcode: rcode, updates: make(chan receivedUpdate, 10)}
+	s.server = &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(s.serveDNS)}
+	if signingKey != nil {
+		s.server.TsigSecret = map[string]string{dns.Fqdn(signingKey.Name): signingKey.Secret}
+	}
+	started := make(chan struct{})
+	s.server.NotifyStartedFunc = func() { close(started) }
+	go s.server.ActivateAndServe()
+	<-started
+	return s
+}
+
+func (s *testDNSServer) addr() string {
+	return s.server.PacketConn.LocalAddr().String()
+}
+
+func (s *testDNSServer) close() {
+	s.server.Shutdown()
+}
+
+func (s *testDNSServer) serveDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if r.Opcode != dns.OpcodeUpdate || len(r.Question) != 1 || len(r.Ns) != 1 {
+		s.t.Errorf("unexpected message %s", r.String())
+	}
+
+	tsig := r.IsTsig()
+	switch {
+	case s.key == nil && tsig != nil:
+		s.t.Errorf("expected unsigned update")
+	case s.key != nil && tsig == nil:
+		s.t.Errorf("expected signed update")
+	case s.key != nil && (tsig.Hdr.Name != dns.Fqdn(s.key.Name) || tsig.Algorithm != dns.HmacSHA256):
+		s.t.Errorf("expected update signed with key '%s' but got '%s' with algorithm '%s'", s.key.Name, tsig.Hdr.Name, tsig.Algorithm)
+	case s.key != nil && s.signingKey == s.key && w.TsigStatus() != nil:
+		s.t.Errorf("invalid tsig signature: %s", w.TsigStatus().Error())
+	}
+
+	rr := r.Ns[0]
+	u := receivedUpdate{
+		zone:   strings.TrimSuffix(r.Question[0].Name, "."),
+		name:   strings.TrimSuffix(rr.Header().Name, "."),
+		rrtype: rr.Header().Rrtype,
+		class:  rr.Header().Class,
+		ttl:    rr.Header().Ttl,
+	}
+	switch rr := rr.(type) {
+	case *dns.A:
+		u.rdata = rr.A.String()
+	case *dns.AAAA:
+		u.rdata = rr.AAAA.String()
+	case *dns.PTR:
+		u.rdata = strings.TrimSuffix(rr.Ptr, ".")
+	}
+	s.updates <- u
+
+	m := &dns.Msg{}
+	m.SetRcode(r, s.rcode)
+	if tsig != nil && s.signingKey != nil {
+		m.SetTsig(dns.Fqdn(s.signingKey.Name), dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	}
+	w.WriteMsg(m)
+}
+
+func TestDNSPublisher(t *testing.T) {
+	type testDef struct {
+		name     string
+		n        notification
+		expected []receivedUpdate
+	}
+
+	key := &tsigKey{Name: "keepalived", Secret: base64.StdEncoding.EncodeToString([]byte("s3cret"))}
+	server := newTestDNSServer(t, key, key, dns.RcodeSuccess)
+	defer server.close()
+
+	p := newDNSPublisher(dnsConfig{
+		Server:       server.addr(),
+		Zone:         "lb.example.com.",
+		ReverseZones: []string{"0.10.in-addr.arpa", "8.b.d.0.1.0.0.2.ip6.arpa"},
+		TSIG:         key,
+	})
+
+	tests := []testDef{
+		{
+			name: "allocate",
+			n:    notification{Event: notificationAllocate, Hostname: "web.default.lb.example.com", IP: "10.0.0.1"},
+			expected: []receivedUpdate{
+				{zone: "lb.example.com", name: "web.default.lb.example.com", rrtype: dns.TypeA, class: dns.ClassINET, ttl: defaultDNSTTL, rdata: "10.0.0.1"},
+				{zone: "0.10.in-addr.arpa", name: "1.0.0.10.in-addr.arpa", rrtype: dns.TypePTR, class: dns.ClassINET, ttl: defaultDNSTTL, rdata: "web.default.lb.example.com"},
+			},
+		},
+		{
+			name: "allocate ipv6",
+			n:    notification{Event: notificationAllocate, Hostname: "web.default.lb.example.com", IP: "2001:db8::1"},
+			expected: []receivedUpdate{
+				{zone: "lb.example.com", name: "web.default.lb.example.com", rrtype: dns.TypeAAAA, class: dns.ClassINET, ttl: defaultDNSTTL, rdata: "2001:db8::1"},
+				{zone: "8.b.d.0.1.0.0.2.ip6.arpa", name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", rrtype: dns.TypePTR, class: dns.ClassINET, ttl: defaultDNSTTL, rdata: "web.default.lb.example.com"},
+			},
+		},
+		{
+			name: "release",
+			n:    notification{Event: notificationRelease, Hostname: "web.default.lb.example.com", IP: "10.0.0.1"},
+			expected: []receivedUpdate{
+				{zone: "lb.example.com", name: "web.default.lb.example.com", rrtype: dns.TypeA, class: dns.ClassNONE, rdata: "10.0.0.1"},
+				{zone: "0.10.in-addr.arpa", name: "1.0.0.10.in-addr.arpa", rrtype: dns.TypePTR, class: dns.ClassNONE, rdata: "web.default.lb.example.com"},
+			},
+		},
+		{
+			name: "reallocate outside reverse zones",
+			n:    notification{Event: notificationReallocate, Hostname: "web.default.lb.example.com", IP: "10.1.0.1", PreviousHostname: "web.default.lb.example.com", PreviousIP: "10.0.0.1"},
+			expected: []receivedUpdate{
+				{zone: "lb.example.com", name: "web.default.lb.example.com", rrtype: dns.TypeA, class: dns.ClassNONE, rdata: "10.0.0.1"},
+				{zone: "0.10.in-addr.arpa", name: "1.0.0.10.in-addr.arpa", rrtype: dns.TypePTR, class: dns.ClassNONE, rdata: "web.default.lb.example.com"},
+				{zone: "lb.example.com", name: "web.default.lb.example.com", rrtype: dns.TypeA, class: dns.ClassINET, ttl: defaultDNSTTL, rdata: "10.1.0.1"},
+			},
+		},
+		{
+			name: "rename",
+			n:    notification{Event: notificationRename, Hostname: "www.default.lb.example.com", IP: "10.0.0.1", PreviousHostname: "web.default.lb.example.com", PreviousIP: "10.0.0.1"},
+			expected: []receivedUpdate{
+				{zone: "lb.example.com", name: "web.default.lb.example.com", rrtype: dns.TypeA, class: dns.ClassNONE, rdata: "10.0.0.1"},
+				{zone: "0.10.in-addr.arpa", name: "1.0.0.10.in-addr.arpa", rrtype: dns.TypePTR, class: dns.ClassNONE, rdata: "web.default.lb.example.com"},
+				{zone: "lb.example.com", name: "www.default.lb.example.com", rrtype: dns.TypeA, class: dns.ClassINET, ttl: defaultDNSTTL, rdata: "10.0.0.1"},
+				{zone: "0.10.in-addr.arpa", name: "1.0.0.10.in-addr.arpa", rrtype: dns.TypePTR, class: dns.ClassINET, ttl: defaultDNSTTL, rdata: "www.default.lb.example.com"},
+			},
+		},
+		{
+			name: "hostname outside zone",
+			n:    notification{Event: notificationAllocate, Hostname: "web.example.org", IP: "10.0.0.1"},
+			expected: []receivedUpdate{
+				{zone: "0.10.in-addr.arpa", name: "1.0.0.10.in-addr.arpa", rrtype: dns.TypePTR, class: dns.ClassINET, ttl: defaultDNSTTL, rdata: "web.example.org"},
+			},
+		},
+		{
+			name: "no hostname",
+			n:    notification{Event: notificationAllocate, IP: "10.0.0.1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				if err := p.publish(test.n); err != nil {
+					t.Errorf("got error: %s", err.Error())
+					return
+				}
+
+				var updates []receivedUpdate
+				for len(updates) < len(test.expected) {
+					select {
+					case u := <-server.updates:
+						updates = append(updates, u)
+					case <-time.After(5 * time.Second):
+						t.Fatalf("timed out waiting for update")
+					}
+				}
+				select {
+				case u := <-server.updates:
+					t.Errorf("unexpected update '%+v'", u)
+				default:
+				}
+
+				if !reflect.DeepEqual(updates, test.expected) {
+					t.Errorf("expected updates '%+v' but got '%+v'", test.expected, updates)
+				}
+			}
+		}(test))
+	}
+}
+
+func TestDNSPublisherRefused(t *testing.T) {
+	server := newTestDNSServer(t, nil, nil, dns.RcodeRefused)
+	defer server.close()
+
+	p := newDNSPublisher(dnsConfig{Server: server.addr(), Zone: "lb.example.com"})
+	err := p.publish(notification{Event: notificationAllocate, Hostname: "web.lb.example.com", IP: "10.0.0.1"})
+	if err == nil || !strings.Contains(err.Error(), "REFUSED") {
+		t.Errorf("expected REFUSED error but got '%v'", err)
+	}
+}
+
+func TestDNSPublisherVerifiesResponse(t *testing.T) {
+	key := &tsigKey{Name: "keepalived", Secret: base64.StdEncoding.EncodeToString([]byte("s3cret"))}
+	other := &tsigKey{Name: "keepalived", Secret: base64.StdEncoding.EncodeToString([]byte("other"))}
+
+	// a NOERROR response that is unsigned, or signed with another key,
+	// could have been spoofed
+	for _, signingKey := range []*tsigKey{nil, other} {
+		server := newTestDNSServer(t, key, signingKey, dns.RcodeSuccess)
+		p := newDNSPublisher(dnsConfig{Server: server.addr(), Zone: "lb.example.com", TSIG: key})
+		err := p.publish(notification{Event: notificationAllocate, Hostname: "web.lb.example.com", IP: "10.0.0.1"})
+		server.close()
+		if err == nil {
+			t.Errorf("expected error for response signed with %+v", signingKey)
+		}
+	}
+}
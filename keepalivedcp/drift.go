@@ -0,0 +1,265 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// driftPolicyRemove overwrites the ConfigMap data with the data rendered
+	// from the config annotation, removing any entries added by hand
+	driftPolicyRemove = "remove"
+	// driftPolicyAdopt imports entries added by hand for LoadBalancer
+	// services into the config annotation before overwriting the data
+	driftPolicyAdopt = "adopt"
+)
+
+const eventReasonConfigMapDrift = "ConfigMapDrift"
+
+// driftReconciler periodically re-renders the ConfigMap data from the config
+// annotation, which is authoritative, and reports and repairs any drift
+// between the two, eg. caused by the ConfigMap being edited by hand.
+type driftReconciler struct {
+	lb     *KeepalivedLoadBalancer
+	policy string
+	// resolve looks up the service of a ConfigMap entry being adopted
+	resolve func(ip, value string) (serviceConfig, error)
+}
+
+func newDriftReconciler(lb *KeepalivedLoadBalancer, policy string) *driftReconciler {
+	return &driftReconciler{lb: lb, policy: policy, resolve: lb.resolveConfigMapEntry}
+}
+
+// Run reconciles the ConfigMap every interval until stopCh is closed.
+func (d *driftReconciler) Run(interval time.Duration, stopCh <-chan struct{}) {
+	glog.Infof("reconciling configmap data every %s with drift policy '%s'", interval, d.policy)
+	wait.Until(func() {
+		if err := d.reconcile(); err != nil {
+			glog.Errorf("error reconciling configmap data: %s", err.Error())
+		}
+	}, interval, stopCh)
+}
+
+func (d *driftReconciler) reconcile() error {
+	cm, err := d.lb.getConfigMap()
+
+	if err != nil {
+		return err
+	}
+
+	cfg, err := configFrom(cm)
+
+	if err != nil {
+		return err
+	}
+
+	desired, drift, adopted, err := d.desiredData(cm.Data, cfg)
+	if err != nil {
+		return err
+	}
+	if len(drift) == 0 && !adopted {
+		return nil
+	}
+
+	for _, msg := range drift {
+		glog.Warningf("configmap %s/%s has drifted from config: %s", cm.Namespace, cm.Name, msg)
+	}
+	if d.lb.recorder != nil && len(drift) > 0 {
+		d.lb.recorder.Eventf(cm, apiv1.EventTypeWarning, eventReasonConfigMapDrift, "Repaired %d drifted entries: %s", len(drift), strings.Join(drift, "; "))
+	}
+
+	cm.Data = desired
+	return d.lb.updateConfigMap(cm, cfg)
+}
+
+// desiredData returns the ConfigMap data rendered from cfg, and how data has
+// drifted from it. Under the adopt policy, entries in data are first adopted
+// into cfg, and adopted is true if cfg was changed.
+func (d *driftReconciler) desiredData(data map[string]string, cfg *config) (desired map[string]string, drift []string, adopted bool, err error) {
+	if d.policy == driftPolicyAdopt && d.lb.configFormat == configFormatVIP {
+		adopted = d.adopt(data, cfg)
+	}
+	if desired, err = d.lb.configMapData(cfg); err != nil {
+		return nil, nil, false, err
+	}
+	return desired, diffData(data, desired), adopted, nil
+}
+
+// adopt adds entries in the ConfigMap data that are not in cfg to cfg, if
+// they refer to an existing LoadBalancer service that has not already been
+// allocated an IP. Entries whose IP is outside every pool, in a pool that is
+// not permitted in the service's namespace, or over the namespace's quota
+// are kept unmanaged and their IPs reserved instead, as they were not
+// allocated by the provider. It returns true if cfg was changed.
+func (d *driftReconciler) adopt(data map[string]string, cfg *config) bool {
+	allocated := make(map[string]bool, len(cfg.Services))
+	for _, svc := range cfg.Services {
+		allocated[svc.IP] = true
+	}
+	for ip := range cfg.Unmanaged {
+		allocated[ip] = true
+	}
+
+	ips := make([]string, 0, len(data))
+	for ip := range data {
+		if !allocated[ip] {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+
+	changed := false
+	for _, ip := range ips {
+		v := data[ip]
+		sc, err := d.resolve(ip, v)
+		if err != nil {
+			glog.Warningf("not adopting configmap entry '%s: %s': %s", ip, v, err.Error())
+			continue
+		}
+		if _, ok := cfg.serviceByUID(sc.UID); ok {
+			glog.Warningf("not adopting configmap entry '%s: %s': service already has an allocation", ip, v)
+			continue
+		}
+		if sc, err = d.lb.checkAdoptable(cfg, sc); err != nil {
+			glog.Warningf("keeping configmap entry '%s: %s' unmanaged and reserving its ip: %s", ip, v, err.Error())
+			cfg.keepUnmanaged(ip, v)
+			changed = true
+			continue
+		}
+		glog.Infof("adopting configmap entry '%s: %s' for service %s", ip, v, sc.UID)
+		cfg.ensureService(sc)
+		changed = true
+	}
+	return changed
+}
+
+// checkAdoptable returns an error if the IP of sc could not have been
+// allocated to it by the provider: if it is outside every pool, its pool is
+// not permitted in sc's namespace, or the namespace's quota would be exceeded.
+// Otherwise sc is returned with the pool and zone of its IP.
+func (k *KeepalivedLoadBalancer) checkAdoptable(cfg *config, sc serviceConfig) (serviceConfig, error) {
+	p, ok := k.poolContaining(sc.IP)
+	if !ok {
+		return sc, fmt.Errorf("ip is not in any pool")
+	}
+
+	permitted, err := k.permittedPools(sc)
+	if err != nil {
+		return sc, err
+	}
+	found := false
+	for _, pp := range permitted {
+		if pp == p {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return sc, fmt.Errorf("pool '%s' is not permitted in namespace '%s'", p.Name, sc.ServiceNamespace)
+	}
+
+	if _, err := k.withinQuota(cfg, sc, []*pool{p}); err != nil {
+		return sc, err
+	}
+
+	sc.Pool, sc.Zone = p.Name, p.Zone
+	return sc, nil
+}
+
+// unmanagedEntryError is returned by resolveConfigMapEntry when an entry
+// is not for a LoadBalancer service, and so can never be imported, as opposed
+// to when the service could not be looked up.
+type unmanagedEntryError struct {
+	reason string
+}
+
+func (e unmanagedEntryError) Error() string {
+	return e.reason
+}
+
+// resolveConfigMapEntry looks up the LoadBalancer service referred to by a
+// kube-keepalived-vip ConfigMap entry, returning a serviceConfig that
+// allocates ip to it. An unmanagedEntryError is returned if the entry is
+// invalid, or its service does not exist or is not a LoadBalancer.
+func (k *KeepalivedLoadBalancer) resolveConfigMapEntry(ip, value string) (serviceConfig, error) {
+	if net.ParseIP(ip) == nil {
+		return serviceConfig{}, unmanagedEntryError{fmt.Sprintf("invalid ip '%s'", ip)}
+	}
+
+	ns, name, method, err := parseConfigMapValue(value)
+	if err != nil {
+		return serviceConfig{}, unmanagedEntryError{err.Error()}
+	}
+
+	svc, err := k.kubeClient.CoreV1().Services(ns).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return serviceConfig{}, unmanagedEntryError{fmt.Sprintf("service %s/%s not found", ns, name)}
+	}
+	if err != nil {
+		return serviceConfig{}, fmt.Errorf("error getting service: %s", err.Error())
+	}
+
+	if svc.Spec.Type != apiv1.ServiceTypeLoadBalancer {
+		return serviceConfig{}, unmanagedEntryError{fmt.Sprintf("service is of type %s", svc.Spec.Type)}
+	}
+
+	sc := serviceConfig{
+		UID:              string(svc.UID),
+		IP:               ip,
+		ServiceNamespace: ns,
+		ServiceName:      name,
+		ForwardMethod:    method,
+	}
+	if method == forwardMethodProxy {
+		sc.ForwardMethod, sc.ProxyProtocol = "", proxyProtocolV1
+	}
+	return sc, nil
+}
+
+// parseConfigMapValue parses a kube-keepalived-vip ConfigMap value in the
+// format namespace/name[:method].
+func parseConfigMapValue(v string) (namespace, name, method string, err error) {
+	if i := strings.Index(v, ":"); i >= 0 {
+		v, method = v[:i], v[i+1:]
+	}
+	parts := strings.Split(v, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", fmt.Errorf("invalid entry '%s': expected namespace/name[:method]", v)
+	}
+	if method != "" && method != forwardMethodProxy && !validForwardMethods[method] {
+		return "", "", "", fmt.Errorf("invalid forward method '%s' in entry '%s'", method, v)
+	}
+	return parts[0], parts[1], method, nil
+}
+
+// diffData returns a sorted description of each difference between the
+// actual and desired ConfigMap data.
+func diffData(actual, desired map[string]string) []string {
+	var diffs []string
+	for k, v := range desired {
+		a, ok := actual[k]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("missing '%s'", k))
+		case a != v:
+			diffs = append(diffs, fmt.Sprintf("modified '%s'", k))
+		}
+	}
+	for k := range actual {
+		if _, ok := desired[k]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected '%s'", k))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
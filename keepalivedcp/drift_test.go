@@ -0,0 +1,203 @@
+package keepalivedcp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigMapValue(t *testing.T) {
+	type testDef struct {
+		value     string
+		namespace string
+		name      string
+		method    string
+		err       bool
+	}
+
+	tests := []testDef{
+		{value: "default/nginx", namespace: "default", name: "nginx"},
+		{value: "default/nginx:DR", namespace: "default", name: "nginx", method: "DR"},
+		{value: "default/nginx:PROXY", namespace: "default", name: "nginx", method: "PROXY"},
+		{value: "default/nginx:NAT;lb_algo=wrr", err: true},
+		{value: "nginx", err: true},
+		{value: "default/", err: true},
+		{value: "a/b/c", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				ns, name, method, err := parseConfigMapValue(test.value)
+
+				if err != nil {
+					if test.err {
+						return
+					}
+
+					t.Errorf("got error: %s", err.Error())
+					return
+				}
+
+				if test.err {
+					t.Errorf("expected error but got none")
+					return
+				}
+
+				if ns != test.namespace || name != test.name || method != test.method {
+					t.Errorf("expected '%s', '%s', '%s' but got '%s', '%s', '%s'", test.namespace, test.name, test.method, ns, name, method)
+				}
+			}
+		}(test))
+	}
+}
+
+func TestDiffData(t *testing.T) {
+	actual := map[string]string{
+		"10.0.0.1": "default/a",
+		"10.0.0.2": "default/b:DR",
+		"10.0.0.9": "default/manual",
+	}
+	desired := map[string]string{
+		"10.0.0.1": "default/a",
+		"10.0.0.2": "default/b",
+		"10.0.0.3": "default/c",
+	}
+
+	expected := []string{
+		"missing '10.0.0.3'",
+		"modified '10.0.0.2'",
+		"unexpected '10.0.0.9'",
+	}
+
+	if diffs := diffData(actual, desired); !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expected diffs %v but got %v", expected, diffs)
+	}
+}
+
+func TestDriftReconcilerDesiredData(t *testing.T) {
+	type testDef struct {
+		name      string
+		policy    string
+		data      map[string]string
+		adopted   bool
+		expected  map[string]string
+		drift     []string
+		services  []string
+		unmanaged []string
+	}
+
+	// resolve stands in for looking up services, which have their name as
+	// their UID, except for a service named missing, which does not exist
+	resolve := func(ip, value string) (serviceConfig, error) {
+		ns, name, _, err := parseConfigMapValue(value)
+		if err != nil || name == "missing" {
+			return serviceConfig{}, unmanagedEntryError{"service not found"}
+		}
+		return serviceConfig{UID: name, IP: ip, ServiceNamespace: ns, ServiceName: name}, nil
+	}
+
+	data := map[string]string{
+		"10.0.0.1":    "default/a",
+		"10.0.0.2":    "default/b",
+		"10.0.0.3":    "quota/c",
+		"10.0.0.4":    "quota/d",
+		"10.0.0.5":    "default/missing",
+		"10.0.1.1":    "default/e",
+		"192.168.0.1": "default/f",
+	}
+
+	tests := []testDef{
+		{
+			name:     "in sync",
+			policy:   driftPolicyAdopt,
+			data:     map[string]string{"10.0.0.1": "default/a"},
+			expected: map[string]string{"10.0.0.1": "default/a"},
+			services: []string{"a"},
+		},
+		{
+			name:     "remove",
+			policy:   driftPolicyRemove,
+			data:     data,
+			expected: map[string]string{"10.0.0.1": "default/a"},
+			drift: []string{
+				"unexpected '10.0.0.2'",
+				"unexpected '10.0.0.3'",
+				"unexpected '10.0.0.4'",
+				"unexpected '10.0.0.5'",
+				"unexpected '10.0.1.1'",
+				"unexpected '192.168.0.1'",
+			},
+			services: []string{"a"},
+		},
+		{
+			name:    "adopt",
+			policy:  driftPolicyAdopt,
+			data:    data,
+			adopted: true,
+			expected: map[string]string{
+				"10.0.0.1":    "default/a",
+				"10.0.0.2":    "default/b",
+				"10.0.0.3":    "quota/c",
+				"10.0.0.4":    "quota/d",
+				"10.0.1.1":    "default/e",
+				"192.168.0.1": "default/f",
+			},
+			drift: []string{"unexpected '10.0.0.5'"},
+			// d is over its namespace's quota, e is in a pool that is not
+			// permitted in its namespace, and f is outside every pool
+			services:  []string{"a", "b", "c"},
+			unmanaged: []string{"10.0.0.4", "10.0.1.1", "192.168.0.1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				k := NewKeepalivedLoadBalancer(nil, nil, "", "", "", "", "")
+				k.pools = []pool{
+					{Name: "shared", CIDR: "10.0.0.0/24"},
+					{Name: "tenant-a", CIDR: "10.0.1.0/24", Namespaces: []string{"tenant-a"}},
+				}
+				k.quotas = []quota{{Namespace: "quota", VIPs: intPtr(1)}}
+				d := newDriftReconciler(k, test.policy)
+				d.resolve = resolve
+
+				cfg := &config{Version: currentConfigVersion}
+				cfg.ensureService(serviceConfig{UID: "a", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "a", Pool: "shared"})
+
+				desired, drift, adopted, err := d.desiredData(test.data, cfg)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+				if adopted != test.adopted {
+					t.Errorf("expected adopted to be %t but got %t", test.adopted, adopted)
+				}
+				if !reflect.DeepEqual(desired, test.expected) {
+					t.Errorf("expected data %v but got %v", test.expected, desired)
+				}
+				if !reflect.DeepEqual(drift, test.drift) {
+					t.Errorf("expected drift %v but got %v", test.drift, drift)
+				}
+
+				var services []string
+				for _, s := range cfg.Services {
+					services = append(services, s.UID)
+					if s.Pool != "shared" {
+						t.Errorf("expected service %s to be in pool 'shared' but got '%s'", s.UID, s.Pool)
+					}
+				}
+				if !reflect.DeepEqual(services, test.services) {
+					t.Errorf("expected services %v but got %v", test.services, services)
+				}
+				for _, ip := range test.unmanaged {
+					if _, ok := cfg.Unmanaged[ip]; !ok || !cfg.isReserved(ip) {
+						t.Errorf("expected %s to be unmanaged and reserved", ip)
+					}
+				}
+				if len(cfg.Unmanaged) != len(test.unmanaged) {
+					t.Errorf("expected %d unmanaged entries but got %v", len(test.unmanaged), cfg.Unmanaged)
+				}
+			}
+		}(test))
+	}
+}
@@ -0,0 +1,244 @@
+package keepalivedcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// maxDryRunDiffs is the number of diffs kept for the debug endpoint.
+const maxDryRunDiffs = 100
+
+// dryRunDiff is a change to the ConfigMap that was not made because the
+// controller is running in dry-run mode.
+type dryRunDiff struct {
+	Time       time.Time `json:"time"`
+	Annotation []string  `json:"annotation"`
+	Data       []string  `json:"data"`
+}
+
+// dryRunLog keeps the most recent diffs computed in dry-run mode, and serves
+// them over HTTP.
+type dryRunLog struct {
+	mu    sync.Mutex
+	diffs []dryRunDiff
+}
+
+func (d *dryRunLog) add(diff dryRunDiff) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.diffs = append(d.diffs, diff)
+	if len(d.diffs) > maxDryRunDiffs {
+		d.diffs = d.diffs[len(d.diffs)-maxDryRunDiffs:]
+	}
+}
+
+// ServeHTTP writes the recorded diffs, most recent last, as JSON if requested
+// with ?format=json, or otherwise as text.
+func (d *dryRunLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	diffs := make([]dryRunDiff, len(d.diffs))
+	copy(diffs, d.diffs)
+	d.mu.Unlock()
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(diffs)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, diff := range diffs {
+		fmt.Fprint(w, diff.String())
+	}
+}
+
+func (d dryRunDiff) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "=== %s\n", d.Time.Format(time.RFC3339))
+	fmt.Fprintf(&b, "--- annotation %s\n", configMapAnnotationKey)
+	for _, l := range d.Annotation {
+		fmt.Fprintln(&b, l)
+	}
+	fmt.Fprintf(&b, "--- data\n")
+	for _, l := range d.Data {
+		fmt.Fprintln(&b, l)
+	}
+	return b.String()
+}
+
+// recordDryRun computes the difference between the live config annotation
+// and data and the ones that would have been written, and logs it.
+func (k *KeepalivedLoadBalancer) recordDryRun(liveAnnotation string, liveData map[string]string, annotation string, data map[string]string) {
+	diff := dryRunDiff{
+		Time:       time.Now(),
+		Annotation: annotationDiff(liveAnnotation, annotation),
+		Data:       dataDiff(liveData, data),
+	}
+
+	glog.Infof("dry run: not updating configmap %s/%s, diff:\n%s", k.namespace, k.name, diff.String())
+	if k.dryRunLog != nil {
+		k.dryRunLog.add(diff)
+	}
+}
+
+// annotationDiff returns the services, by UID, and the nodes and reserved IPs
+// that differ between the configs a and b, as compact JSON prefixed by '- '
+// if they were removed or '+ ' if they were added. Unchanged services are
+// left out, so the diff stays small however many services there are.
+func annotationDiff(a, b string) []string {
+	oldCfg, err := decodeConfig([]byte(a))
+	if err != nil {
+		if a != "" {
+			return []string{"- " + a, "+ " + b}
+		}
+		oldCfg = &config{}
+	}
+	newCfg, err := decodeConfig([]byte(b))
+	if err != nil {
+		return []string{"- " + a, "+ " + b}
+	}
+
+	newServices := map[string]serviceConfig{}
+	for _, svc := range newCfg.Services {
+		newServices[svc.UID] = svc
+	}
+
+	var diff []string
+	seen := map[string]bool{}
+	for _, svc := range oldCfg.Services {
+		seen[svc.UID] = true
+		old := compactJSON(svc)
+		n, ok := newServices[svc.UID]
+		if !ok {
+			diff = append(diff, "- "+old)
+			continue
+		}
+		if updated := compactJSON(n); updated != old {
+			diff = append(diff, "- "+old, "+ "+updated)
+		}
+	}
+	for _, svc := range newCfg.Services {
+		if !seen[svc.UID] {
+			diff = append(diff, "+ "+compactJSON(svc))
+		}
+	}
+
+	if old, updated := compactJSON(oldCfg.Nodes), compactJSON(newCfg.Nodes); old != updated {
+		diff = append(diff, "- nodes: "+old, "+ nodes: "+updated)
+	}
+	if old, updated := compactJSON(oldCfg.Reserved), compactJSON(newCfg.Reserved); old != updated {
+		diff = append(diff, "- reserved: "+old, "+ reserved: "+updated)
+	}
+	return diff
+}
+
+// compactJSON returns v encoded as JSON on a single line.
+func compactJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
+
+// dataDiff returns the lines of the entries of a and b that differ, sorted
+// by key, as 'key: value' lines prefixed by '- ' if they were removed or
+// '+ ' if they were added. Multi-line values are continued on lines prefixed
+// with the key, and only their changed lines are included.
+func dataDiff(a, b map[string]string) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var diff []string
+	for _, k := range keys {
+		old, hadOld := a[k]
+		updated, hasNew := b[k]
+		switch {
+		case !hasNew:
+			for _, l := range dataLines(map[string]string{k: old}) {
+				diff = append(diff, "- "+l)
+			}
+		case !hadOld:
+			for _, l := range dataLines(map[string]string{k: updated}) {
+				diff = append(diff, "+ "+l)
+			}
+		case old != updated:
+			removed, added := lineChanges(strings.Split(old, "\n"), strings.Split(updated, "\n"))
+			for _, l := range removed {
+				diff = append(diff, "- "+k+": "+l)
+			}
+			for _, l := range added {
+				diff = append(diff, "+ "+k+": "+l)
+			}
+		}
+	}
+	return diff
+}
+
+// dataLines returns the entries of data as 'key: value' lines, sorted by
+// key. Multi-line values are continued on lines prefixed with the key.
+func dataLines(data map[string]string) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, k := range keys {
+		for i, l := range strings.Split(data[k], "\n") {
+			if i == 0 {
+				lines = append(lines, k+": "+l)
+				continue
+			}
+			lines = append(lines, k+":   "+l)
+		}
+	}
+	return lines
+}
+
+// lineChanges returns the lines of a that are not in b and the lines of b
+// that are not in a, counting repeated lines, in linear time. Unlike a
+// longest common subsequence, it does not report lines that only moved.
+func lineChanges(a, b []string) (removed, added []string) {
+	counts := map[string]int{}
+	for _, l := range b {
+		counts[l]++
+	}
+	for _, l := range a {
+		if counts[l] > 0 {
+			counts[l]--
+			continue
+		}
+		removed = append(removed, l)
+	}
+
+	counts = map[string]int{}
+	for _, l := range a {
+		counts[l]++
+	}
+	for _, l := range b {
+		if counts[l] > 0 {
+			counts[l]--
+			continue
+		}
+		added = append(added, l)
+	}
+	return removed, added
+}
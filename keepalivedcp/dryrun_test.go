@@ -0,0 +1,72 @@
+package keepalivedcp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineChanges(t *testing.T) {
+	a := []string{"a", "b", "c", "d", "d"}
+	b := []string{"d", "a", "c", "e", "d"}
+
+	removed, added := lineChanges(a, b)
+	if expected := []string{"b"}; !reflect.DeepEqual(removed, expected) {
+		t.Errorf("expected removed lines %v but got %v", expected, removed)
+	}
+	if expected := []string{"e"}; !reflect.DeepEqual(added, expected) {
+		t.Errorf("expected added lines %v but got %v", expected, added)
+	}
+}
+
+func TestDataLines(t *testing.T) {
+	data := map[string]string{
+		"10.0.0.2": "default/b",
+		"10.0.0.1": "default/a:DR",
+	}
+
+	expected := []string{"10.0.0.1: default/a:DR", "10.0.0.2: default/b"}
+
+	if lines := dataLines(data); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected lines %v but got %v", expected, lines)
+	}
+}
+
+func TestDataDiff(t *testing.T) {
+	a := map[string]string{
+		"10.0.0.1":        "default/a:DR",
+		"10.0.0.2":        "default/b",
+		"keepalived.conf": "global_defs {\n}\nvirtual_server 10.0.0.1 80 {\n}",
+	}
+	b := map[string]string{
+		"10.0.0.1":        "default/a:DR",
+		"10.0.0.3":        "default/c",
+		"keepalived.conf": "global_defs {\n}\nvirtual_server 10.0.0.3 80 {\n}",
+	}
+
+	expected := []string{
+		"- 10.0.0.2: default/b",
+		"+ 10.0.0.3: default/c",
+		"- keepalived.conf: virtual_server 10.0.0.1 80 {",
+		"+ keepalived.conf: virtual_server 10.0.0.3 80 {",
+	}
+
+	if diff := dataDiff(a, b); !reflect.DeepEqual(diff, expected) {
+		t.Errorf("expected diff %v but got %v", expected, diff)
+	}
+}
+
+func TestAnnotationDiff(t *testing.T) {
+	a := `{"version":1,"services":[{"uid":"1","ip":"10.0.0.1"},{"uid":"2","ip":"10.0.0.2"}],"nodes":["192.168.0.1"]}`
+	b := `{"version":1,"services":[{"uid":"1","ip":"10.0.0.1"},{"uid":"3","ip":"10.0.0.3"}],"nodes":["192.168.0.1"]}`
+
+	diff := annotationDiff(a, b)
+	if len(diff) != 2 || diff[0][:2] != "- " || diff[1][:2] != "+ " {
+		t.Fatalf("expected one removed and one added service but got %v", diff)
+	}
+	if old, _ := decodeConfig([]byte(a)); compactJSON(old.Services[1]) != diff[0][2:] {
+		t.Errorf("expected removed service %s but got %s", compactJSON(old.Services[1]), diff[0][2:])
+	}
+	if updated, _ := decodeConfig([]byte(b)); compactJSON(updated.Services[1]) != diff[1][2:] {
+		t.Errorf("expected added service %s but got %s", compactJSON(updated.Services[1]), diff[1][2:])
+	}
+}
@@ -0,0 +1,192 @@
+package keepalivedcp
+
+import (
+	"fmt"
+
+	"github.com/ghodss/yaml"
+)
+
+// envoyConfKey is the key of the rendered Envoy static resources.
+const envoyConfKey = "envoy.yaml"
+
+const (
+	envoyTCPProxyType      = "type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy"
+	envoyProxyProtocolType = "type.googleapis.com/envoy.extensions.transport_sockets.proxy_protocol.v3.ProxyProtocolUpstreamTransport"
+	envoyRawBufferType     = "type.googleapis.com/envoy.extensions.transport_sockets.raw_buffer.v3.RawBuffer"
+)
+
+// envoyResources are the listeners and clusters forwarding services, in the
+// format of the static_resources of an Envoy bootstrap, and of the
+// resources served over xDS.
+type envoyResources struct {
+	Listeners []map[string]interface{} `json:"listeners"`
+	Clusters  []map[string]interface{} `json:"clusters"`
+}
+
+// renderEnvoy renders the static_resources of an Envoy bootstrap for the TCP
+// ports of services, to be merged into a bootstrap that configures the rest
+// of Envoy. Each VIP and port is a listener, forwarding to a cluster per
+// service with the nodes as endpoints on the port's NodePort. Envoy must be
+// allowed to bind VIPs that are not held by the node, eg. with the
+// net.ipv4.ip_nonlocal_bind sysctl.
+func renderEnvoy(services []serviceConfig, nodes []string) (string, error) {
+	out, err := yaml.Marshal(map[string]interface{}{"static_resources": envoyResourcesFor(services, nodes)})
+	if err != nil {
+		return "", fmt.Errorf("error encoding envoy resources: %s", err.Error())
+	}
+	return fmt.Sprintf("# generated by %s, do not edit\n%s", eventSourceComponent, out), nil
+}
+
+func envoyResourcesFor(services []serviceConfig, nodes []string) *envoyResources {
+	r := &envoyResources{
+		Listeners: []map[string]interface{}{},
+		Clusters:  []map[string]interface{}{},
+	}
+	for _, l := range listeners(services) {
+		r.Listeners = append(r.Listeners, envoyListener(l))
+		for _, s := range l.Services {
+			r.Clusters = append(r.Clusters, envoyCluster(s, nodes))
+		}
+	}
+	return r
+}
+
+func envoyListener(l listener) map[string]interface{} {
+	var chains []interface{}
+	for _, s := range l.Services {
+		if len(s.SNIHostnames) == 0 {
+			continue
+		}
+		chains = append(chains, map[string]interface{}{
+			"filter_chain_match": map[string]interface{}{"server_names": s.SNIHostnames},
+			"filters":            []interface{}{envoyTCPProxy(s)},
+		})
+	}
+	if s, ok := l.defaultService(); ok {
+		chains = append(chains, map[string]interface{}{
+			"filters": []interface{}{envoyTCPProxy(s)},
+		})
+	}
+
+	listener := map[string]interface{}{
+		"name":          l.name(),
+		"address":       envoyAddress(l.IP, l.Port),
+		"filter_chains": chains,
+	}
+	if l.routed() {
+		listener["listener_filters"] = []interface{}{
+			map[string]interface{}{"name": "envoy.filters.listener.tls_inspector"},
+		}
+	}
+	return listener
+}
+
+func envoyTCPProxy(s listenerService) map[string]interface{} {
+	config := map[string]interface{}{
+		"@type":       envoyTCPProxyType,
+		"stat_prefix": s.name(),
+		"cluster":     s.name(),
+	}
+	if envoyLBPolicy(s.Scheduler) == "MAGLEV" {
+		config["hash_policy"] = []interface{}{map[string]interface{}{"source_ip": map[string]interface{}{}}}
+	}
+	return map[string]interface{}{
+		"name":         "envoy.filters.network.tcp_proxy",
+		"typed_config": config,
+	}
+}
+
+func envoyCluster(s listenerService, nodes []string) map[string]interface{} {
+	endpoints := []interface{}{}
+	for _, n := range nodes {
+		endpoints = append(endpoints, map[string]interface{}{
+			"endpoint": map[string]interface{}{"address": envoyAddress(n, s.Port.NodePort)},
+		})
+	}
+
+	cluster := map[string]interface{}{
+		"name":            s.name(),
+		"type":            "STATIC",
+		"connect_timeout": fmt.Sprintf("%ds", defaultHealthCheckTimeout),
+		"lb_policy":       envoyLBPolicy(s.Scheduler),
+		"load_assignment": map[string]interface{}{
+			"cluster_name": s.name(),
+			"endpoints":    []interface{}{map[string]interface{}{"lb_endpoints": endpoints}},
+		},
+	}
+
+	if hc := envoyHealthCheck(s.HealthCheck); hc != nil {
+		cluster["health_checks"] = []interface{}{hc}
+	}
+
+	if s.ProxyProtocol != "" {
+		version := "V1"
+		if s.ProxyProtocol == proxyProtocolV2 {
+			version = "V2"
+		}
+		cluster["transport_socket"] = map[string]interface{}{
+			"name": "envoy.transport_sockets.upstream_proxy_protocol",
+			"typed_config": map[string]interface{}{
+				"@type":  envoyProxyProtocolType,
+				"config": map[string]interface{}{"version": version},
+				"transport_socket": map[string]interface{}{
+					"name":         "envoy.transport_sockets.raw_buffer",
+					"typed_config": map[string]interface{}{"@type": envoyRawBufferType},
+				},
+			},
+		}
+	}
+
+	return cluster
+}
+
+// envoyHealthCheck returns the Envoy health check for a service's health
+// check, or nil if it cannot be performed by Envoy.
+func envoyHealthCheck(check *healthCheck) map[string]interface{} {
+	hc := defaultHealthCheck
+	if check != nil {
+		hc = *check
+	}
+
+	h := map[string]interface{}{
+		"timeout":             fmt.Sprintf("%ds", defaultHealthCheckTimeout),
+		"interval":            fmt.Sprintf("%ds", hc.interval()),
+		"unhealthy_threshold": hc.retries(),
+		"healthy_threshold":   1,
+	}
+	switch hc.Type {
+	case healthCheckTCP:
+		h["tcp_health_check"] = map[string]interface{}{}
+	case healthCheckSSL:
+		// checking over TLS needs a TLS transport socket on the cluster,
+		// which would also be used for the proxied connections, so only
+		// connect to the endpoints
+		h["tcp_health_check"] = map[string]interface{}{}
+	case healthCheckHTTP:
+		h["http_health_check"] = map[string]interface{}{
+			"path":              hc.path(),
+			"expected_statuses": []interface{}{map[string]interface{}{"start": hc.status(), "end": hc.status() + 1}},
+		}
+	default:
+		return nil
+	}
+	return h
+}
+
+func envoyAddress(ip string, port int32) map[string]interface{} {
+	return map[string]interface{}{
+		"socket_address": map[string]interface{}{"address": ip, "port_value": port},
+	}
+}
+
+// envoyLBPolicy returns the Envoy load balancing policy closest to an IPVS
+// scheduler.
+func envoyLBPolicy(scheduler string) string {
+	switch scheduler {
+	case "lc", "wlc", "lblc":
+		return "LEAST_REQUEST"
+	case "sh", "mh", "dh":
+		return "MAGLEV"
+	}
+	return "ROUND_ROBIN"
+}
@@ -0,0 +1,66 @@
+package keepalivedcp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvoyResources(t *testing.T) {
+	services := []serviceConfig{
+		{
+			UID:              "a",
+			IP:               "10.0.0.1",
+			ServiceNamespace: "tenant-a",
+			ServiceName:      "web",
+			SNIHostnames:     []string{"a.example.com"},
+			ProxyProtocol:    "v1",
+			Ports:            []servicePort{{Protocol: "TCP", Port: 443, NodePort: 30001}},
+		},
+		{
+			UID:              "b",
+			IP:               "10.0.0.1",
+			ServiceNamespace: "default",
+			ServiceName:      "fallback",
+			Scheduler:        "sh",
+			Ports:            []servicePort{{Protocol: "TCP", Port: 443, NodePort: 30002}},
+		},
+	}
+
+	r := envoyResourcesFor(services, []string{"192.168.0.1"})
+
+	if len(r.Listeners) != 1 {
+		t.Fatalf("expected 1 listener but got %d", len(r.Listeners))
+	}
+	l := r.Listeners[0]
+	if l["name"] != "vip_10.0.0.1_443" {
+		t.Errorf("unexpected listener name %v", l["name"])
+	}
+	if _, ok := l["listener_filters"]; !ok {
+		t.Errorf("expected tls inspector for sni routed listener")
+	}
+	chains := l["filter_chains"].([]interface{})
+	if len(chains) != 2 {
+		t.Fatalf("expected 2 filter chains but got %d", len(chains))
+	}
+	match := chains[0].(map[string]interface{})["filter_chain_match"].(map[string]interface{})
+	if !reflect.DeepEqual(match["server_names"], []string{"a.example.com"}) {
+		t.Errorf("unexpected filter chain match %v", match)
+	}
+	if _, ok := chains[1].(map[string]interface{})["filter_chain_match"]; ok {
+		t.Errorf("expected default filter chain without match")
+	}
+
+	if len(r.Clusters) != 2 {
+		t.Fatalf("expected 2 clusters but got %d", len(r.Clusters))
+	}
+	if _, ok := r.Clusters[0]["transport_socket"]; !ok {
+		t.Errorf("expected proxy protocol transport socket on cluster %v", r.Clusters[0]["name"])
+	}
+	if r.Clusters[1]["lb_policy"] != "MAGLEV" {
+		t.Errorf("expected MAGLEV lb policy but got %v", r.Clusters[1]["lb_policy"])
+	}
+
+	if out, err := renderEnvoy(services, []string{"192.168.0.1"}); err != nil || out == "" {
+		t.Errorf("expected rendered envoy config but got error %v", err)
+	}
+}
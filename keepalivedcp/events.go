@@ -0,0 +1,49 @@
+package keepalivedcp
+
+import (
+	"github.com/golang/glog"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+const eventSourceComponent = "keepalived-cloud-provider"
+
+const (
+	eventReasonInvalidConfig      = "InvalidLoadBalancerConfig"
+	eventReasonSettingsNotApplied = "LoadBalancerSettingsNotApplied"
+)
+
+func newEventRecorder(kubeClient kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.Infof)
+	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, apiv1.EventSource{Component: eventSourceComponent})
+}
+
+// serviceRef returns a reference to service that events can be recorded
+// against. The cloudprovider Service type is not registered with the
+// client-go scheme, so the reference is built by hand.
+func serviceRef(service *v1.Service) *apiv1.ObjectReference {
+	return &apiv1.ObjectReference{
+		Kind:            "Service",
+		APIVersion:      "v1",
+		Namespace:       service.Namespace,
+		Name:            service.Name,
+		UID:             service.UID,
+		ResourceVersion: service.ResourceVersion,
+	}
+}
+
+// recordEventf records an event against service, if an event recorder has
+// been configured.
+func (k *KeepalivedLoadBalancer) recordEventf(service *v1.Service, eventtype, reason, messageFmt string, args ...interface{}) {
+	if k.recorder == nil {
+		return
+	}
+	k.recorder.Eventf(serviceRef(service), eventtype, reason, messageFmt, args...)
+}
@@ -0,0 +1,260 @@
+package keepalivedcp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// The messages below are the Go form of allocations.proto. They are encoded
+// by the protobuf library from their struct tags.
+
+// feedAllocation is a VIP and how to forward it, as published to feed
+// subscribers.
+type feedAllocation struct {
+	Namespace     string      `protobuf:"bytes,1,opt,name=namespace"`
+	Name          string      `protobuf:"bytes,2,opt,name=name"`
+	UID           string      `protobuf:"bytes,3,opt,name=uid"`
+	IP            string      `protobuf:"bytes,4,opt,name=ip"`
+	Pool          string      `protobuf:"bytes,5,opt,name=pool"`
+	ForwardMethod string      `protobuf:"bytes,6,opt,name=forward_method,json=forwardMethod"`
+	ProxyProtocol string      `protobuf:"bytes,7,opt,name=proxy_protocol,json=proxyProtocol"`
+	Ports         []*feedPort `protobuf:"bytes,8,rep,name=ports"`
+	Nodes         []string    `protobuf:"bytes,9,rep,name=nodes"`
+}
+
+func (m *feedAllocation) Reset()         { *m = feedAllocation{} }
+func (m *feedAllocation) String() string { return proto.CompactTextString(m) }
+func (*feedAllocation) ProtoMessage()    {}
+
+type feedPort struct {
+	Name     string `protobuf:"bytes,1,opt,name=name"`
+	Protocol string `protobuf:"bytes,2,opt,name=protocol"`
+	Port     int32  `protobuf:"varint,3,opt,name=port"`
+	NodePort int32  `protobuf:"varint,4,opt,name=node_port,json=nodePort"`
+}
+
+func (m *feedPort) Reset()         { *m = feedPort{} }
+func (m *feedPort) String() string { return proto.CompactTextString(m) }
+func (*feedPort) ProtoMessage()    {}
+
+// feedSnapshot is the complete set of allocations. Its version is
+// incremented whenever the allocations change.
+type feedSnapshot struct {
+	Version     uint64            `protobuf:"varint,1,opt,name=version"`
+	Allocations []*feedAllocation `protobuf:"bytes,2,rep,name=allocations"`
+}
+
+func (m *feedSnapshot) Reset()         { *m = feedSnapshot{} }
+func (m *feedSnapshot) String() string { return proto.CompactTextString(m) }
+func (*feedSnapshot) ProtoMessage()    {}
+
+type feedGetRequest struct{}
+
+func (m *feedGetRequest) Reset()         { *m = feedGetRequest{} }
+func (m *feedGetRequest) String() string { return proto.CompactTextString(m) }
+func (*feedGetRequest) ProtoMessage()    {}
+
+type feedWatchRequest struct{}
+
+func (m *feedWatchRequest) Reset()         { *m = feedWatchRequest{} }
+func (m *feedWatchRequest) String() string { return proto.CompactTextString(m) }
+func (*feedWatchRequest) ProtoMessage()    {}
+
+// allocationsServer is the server side of the keepalived.v1.Allocations
+// service.
+type allocationsServer interface {
+	Get(context.Context, *feedGetRequest) (*feedSnapshot, error)
+	Watch(*feedWatchRequest, grpc.ServerStream) error
+}
+
+var allocationsServiceDesc = grpc.ServiceDesc{
+	ServiceName: "keepalived.v1.Allocations",
+	HandlerType: (*allocationsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := &feedGetRequest{}
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(allocationsServer).Get(ctx, in)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/keepalived.v1.Allocations/Get"}
+				return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(allocationsServer).Get(ctx, req.(*feedGetRequest))
+				})
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				in := &feedWatchRequest{}
+				if err := stream.RecvMsg(in); err != nil {
+					return err
+				}
+				return srv.(allocationsServer).Watch(in, stream)
+			},
+		},
+	},
+	Metadata: "allocations.proto",
+}
+
+// allocationFeed pushes the allocations to subscribers whenever they change,
+// so that load balancers outside the cluster can follow them without
+// Kubernetes credentials. Subscribers always receive complete snapshots, and
+// may skip intermediate snapshots if they fall behind.
+//
+// The feed is served as the keepalived.v1.Allocations gRPC service described
+// in allocations.proto.
+type allocationFeed struct {
+	mu          sync.Mutex
+	current     *feedSnapshot
+	subscribers map[chan *feedSnapshot]bool
+}
+
+func newAllocationFeed() *allocationFeed {
+	return &allocationFeed{subscribers: map[chan *feedSnapshot]bool{}}
+}
+
+// publish sends the allocations in cfg to all subscribers, if they have
+// changed since they were last published.
+func (f *allocationFeed) publish(cfg *config) {
+	allocations := feedAllocationsFor(cfg)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.current != nil && reflect.DeepEqual(f.current.Allocations, allocations) {
+		return
+	}
+
+	var version uint64 = 1
+	if f.current != nil {
+		version = f.current.Version + 1
+	}
+	f.current = &feedSnapshot{Version: version, Allocations: allocations}
+
+	for ch := range f.subscribers {
+		// replace any snapshot the subscriber has not received yet, as
+		// only the latest matters
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- f.current
+	}
+}
+
+// subscribe returns a channel that receives the current snapshot, if any, and
+// every following one, until unsubscribe is called.
+func (f *allocationFeed) subscribe() chan *feedSnapshot {
+	ch := make(chan *feedSnapshot, 1)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.subscribers[ch] = true
+	if f.current != nil {
+		ch <- f.current
+	}
+	return ch
+}
+
+func (f *allocationFeed) unsubscribe(ch chan *feedSnapshot) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subscribers, ch)
+}
+
+// Get returns the current snapshot.
+func (f *allocationFeed) Get(ctx context.Context, req *feedGetRequest) (*feedSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.current == nil {
+		return &feedSnapshot{}, nil
+	}
+	return f.current, nil
+}
+
+// Watch sends the current and every following snapshot until the client
+// cancels.
+func (f *allocationFeed) Watch(req *feedWatchRequest, stream grpc.ServerStream) error {
+	ch := f.subscribe()
+	defer f.unsubscribe(ch)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case s := <-ch:
+			if err := stream.SendMsg(s); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// newFeedServer returns a gRPC server for the feed that requires clients to
+// present a certificate signed by the CA in caFile.
+func newFeedServer(f *allocationFeed, certFile, keyFile, caFile string) (*grpc.Server, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading feed certificate: %s", err.Error())
+	}
+
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading feed client ca: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("error reading feed client ca: no certificates found in %s", caFile)
+	}
+
+	creds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	s := grpc.NewServer(grpc.Creds(creds))
+	s.RegisterService(&allocationsServiceDesc, f)
+	return s, nil
+}
+
+func feedAllocationsFor(cfg *config) []*feedAllocation {
+	allocations := []*feedAllocation{}
+	for _, s := range cfg.Services {
+		a := &feedAllocation{
+			Namespace:     s.ServiceNamespace,
+			Name:          s.ServiceName,
+			UID:           s.UID,
+			IP:            s.IP,
+			Pool:          s.Pool,
+			ForwardMethod: s.ForwardMethod,
+			ProxyProtocol: s.ProxyProtocol,
+		}
+		if a.ForwardMethod == "" {
+			a.ForwardMethod = defaultForwardMethod
+		}
+		for _, p := range s.Ports {
+			a.Ports = append(a.Ports, &feedPort{Name: p.Name, Protocol: p.Protocol, Port: p.Port, NodePort: p.NodePort})
+		}
+		a.Nodes = append(a.Nodes, cfg.Nodes...)
+		allocations = append(allocations, a)
+	}
+	return allocations
+}
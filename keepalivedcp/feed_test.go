@@ -0,0 +1,211 @@
+package keepalivedcp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// testCert issues a certificate for localhost signed by parent, or a self
+// signed CA certificate if parent is nil.
+func testCert(t *testing.T, parent *tls.Certificate, serial int64) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err.Error())
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err.Error())
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %s", err.Error())
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writePEM(t *testing.T, path, typ string, b []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+		t.Fatalf("error writing %s: %s", path, err.Error())
+	}
+}
+
+// startFeedServer serves feed on a loopback port, and returns its address, a
+// CA certificate trusted by the server, and a client certificate signed by it.
+func startFeedServer(t *testing.T, feed *allocationFeed) (string, tls.Certificate, tls.Certificate, func()) {
+	dir, err := ioutil.TempDir("", "feed")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err.Error())
+	}
+
+	ca := testCert(t, nil, 1)
+	server := testCert(t, &ca, 2)
+	client := testCert(t, &ca, 3)
+
+	serverKey, err := x509.MarshalECPrivateKey(server.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("error marshalling key: %s", err.Error())
+	}
+	writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", ca.Certificate[0])
+	writePEM(t, filepath.Join(dir, "tls.crt"), "CERTIFICATE", server.Certificate[0])
+	writePEM(t, filepath.Join(dir, "tls.key"), "EC PRIVATE KEY", serverKey)
+
+	s, err := newFeedServer(feed, filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatalf("error creating feed server: %s", err.Error())
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err.Error())
+	}
+	go s.Serve(lis)
+
+	return lis.Addr().String(), ca, client, func() {
+		s.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func dialFeed(t *testing.T, addr string, ca tls.Certificate, certs []tls.Certificate) *grpc.ClientConn {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	creds := credentials.NewTLS(&tls.Config{RootCAs: pool, Certificates: certs, ServerName: "localhost"})
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatalf("error dialing feed: %s", err.Error())
+	}
+	return conn
+}
+
+func TestAllocationFeed(t *testing.T) {
+	feed := newAllocationFeed()
+	addr, ca, client, stop := startFeedServer(t, feed)
+	defer stop()
+
+	cfg := &config{
+		Services: []serviceConfig{
+			{
+				UID:              "a",
+				IP:               "10.0.0.1",
+				ServiceNamespace: "default",
+				ServiceName:      "web",
+				Ports:            []servicePort{{Name: "http", Protocol: "TCP", Port: 80, NodePort: 30080}},
+			},
+		},
+		Nodes: []string{"192.168.0.1"},
+	}
+	feed.publish(cfg)
+
+	conn := dialFeed(t, addr, ca, []tls.Certificate{client})
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := conn.NewStream(ctx, &allocationsServiceDesc.Streams[0], "/keepalived.v1.Allocations/Watch")
+	if err != nil {
+		t.Fatalf("error watching feed: %s", err.Error())
+	}
+	if err := stream.SendMsg(&feedWatchRequest{}); err != nil {
+		t.Fatalf("error watching feed: %s", err.Error())
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("error watching feed: %s", err.Error())
+	}
+
+	next := func() *feedSnapshot {
+		s := &feedSnapshot{}
+		if err := stream.RecvMsg(s); err != nil {
+			t.Fatalf("error receiving snapshot: %s", err.Error())
+		}
+		return s
+	}
+
+	s := next()
+	if s.Version != 1 || len(s.Allocations) != 1 {
+		t.Fatalf("unexpected initial snapshot %v", s)
+	}
+	a := s.Allocations[0]
+	if a.IP != "10.0.0.1" || a.ForwardMethod != defaultForwardMethod || len(a.Ports) != 1 || a.Ports[0].NodePort != 30080 || len(a.Nodes) != 1 {
+		t.Errorf("unexpected allocation %v", a)
+	}
+
+	// publishing unchanged allocations is a no-op
+	feed.publish(cfg)
+
+	cfg.Services = append(cfg.Services, serviceConfig{UID: "b", IP: "10.0.0.2", ServiceNamespace: "default", ServiceName: "db", ForwardMethod: "DR"})
+	feed.publish(cfg)
+
+	s = next()
+	if s.Version != 2 || len(s.Allocations) != 2 || s.Allocations[1].ForwardMethod != "DR" {
+		t.Errorf("unexpected snapshot %v", s)
+	}
+
+	cfg.Services = cfg.Services[1:]
+	feed.publish(cfg)
+
+	s = next()
+	if s.Version != 3 || len(s.Allocations) != 1 || s.Allocations[0].UID != "b" {
+		t.Errorf("unexpected snapshot %v", s)
+	}
+
+	current := &feedSnapshot{}
+	if err := conn.Invoke(ctx, "/keepalived.v1.Allocations/Get", &feedGetRequest{}, current); err != nil {
+		t.Fatalf("error getting feed: %s", err.Error())
+	}
+	if current.Version != 3 {
+		t.Errorf("expected current version 3 but got %d", current.Version)
+	}
+}
+
+func TestAllocationFeedRequiresClientCert(t *testing.T) {
+	feed := newAllocationFeed()
+	addr, ca, _, stop := startFeedServer(t, feed)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// a certificate signed by another CA is refused like no certificate
+	other := testCert(t, nil, 4)
+	for _, certs := range [][]tls.Certificate{nil, {testCert(t, &other, 5)}} {
+		conn := dialFeed(t, addr, ca, certs)
+		err := conn.Invoke(ctx, "/keepalived.v1.Allocations/Get", &feedGetRequest{}, &feedSnapshot{})
+		conn.Close()
+		if err == nil {
+			t.Errorf("expected an error getting feed with %d untrusted certificates", len(certs))
+		}
+	}
+}
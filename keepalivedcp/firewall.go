@@ -0,0 +1,199 @@
+package keepalivedcp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/golang/glog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+const (
+	// firewallFormatNftables renders the rules as an nftables script, to be
+	// applied with nft -f
+	firewallFormatNftables = "nftables"
+	// firewallFormatIptables renders the rules in the format of
+	// iptables-restore
+	firewallFormatIptables = "iptables"
+)
+
+const (
+	firewallNftablesKey = "rules.nft"
+	firewallIptablesKey = "rules.iptables"
+
+	// firewallChain is the nftables table and iptables chain the rules are
+	// rendered into
+	firewallChain = "KEEPALIVED-SOURCE-RANGES"
+)
+
+const (
+	eventReasonSourceRangesNotEnforced = "SourceRangesNotEnforced"
+	eventReasonFirewallSyncFailed      = "FirewallSyncFailed"
+)
+
+// firewall renders rules that restrict the clients of each VIP to its
+// service's source ranges into a ConfigMap, for agents on the nodes that host
+// VIPs to apply.
+type firewall struct {
+	kubeClient      kubernetes.Interface
+	namespace, name string
+	format          string
+	// dryRun causes changes to the rules to be logged but not written
+	dryRun bool
+}
+
+// sync writes the rules for cfg to the firewall's ConfigMap.
+func (f *firewall) sync(cfg *config) error {
+	key, rules := firewallNftablesKey, renderNftables(cfg)
+	if f.format == firewallFormatIptables {
+		key, rules = firewallIptablesKey, renderIptables(cfg)
+	}
+
+	cm, err := f.kubeClient.CoreV1().ConfigMaps(f.namespace).Get(f.name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting firewall configmap: %s", err.Error())
+	}
+	if cm.Data[key] == rules {
+		return nil
+	}
+
+	if f.dryRun {
+		removed, added := lineChanges(strings.Split(cm.Data[key], "\n"), strings.Split(rules, "\n"))
+		glog.Infof("dry run: not updating firewall configmap %s/%s, removed rules:\n%s\nadded rules:\n%s", f.namespace, f.name, strings.Join(removed, "\n"), strings.Join(added, "\n"))
+		return nil
+	}
+
+	cm.Data = map[string]string{key: rules}
+	if _, err := f.kubeClient.CoreV1().ConfigMaps(f.namespace).Update(cm); err != nil {
+		return fmt.Errorf("error updating firewall configmap: %s", err.Error())
+	}
+	return nil
+}
+
+// syncFirewall writes the firewall rules for cfg, if a firewall is
+// configured. The config has already been saved by then, so a failure is
+// logged and recorded as an event against cm, the keepalived ConfigMap,
+// rather than failing the change. The rules are written again after the
+// next change to the config.
+func (k *KeepalivedLoadBalancer) syncFirewall(cm *apiv1.ConfigMap, cfg *config) {
+	if k.firewall == nil {
+		return
+	}
+	if err := k.firewall.sync(cfg); err != nil {
+		glog.Errorf("error syncing firewall rules to configmap %s/%s: %s", k.firewall.namespace, k.firewall.name, err.Error())
+		if k.recorder != nil {
+			k.recorder.Eventf(cm, apiv1.EventTypeWarning, eventReasonFirewallSyncFailed, "Error syncing firewall rules to configmap %s/%s: %s", k.firewall.namespace, k.firewall.name, err.Error())
+		}
+	}
+}
+
+// enforceableRanges splits the source ranges of sc into those that can be
+// enforced for its VIP, and those that cannot as they are of a different IP
+// family.
+func enforceableRanges(sc serviceConfig) (enforceable, unenforceable []string) {
+	v4 := net.ParseIP(sc.IP).To4() != nil
+	for _, r := range sc.SourceRanges {
+		ip, _, err := net.ParseCIDR(r)
+		if err != nil || (ip.To4() != nil) != v4 {
+			unenforceable = append(unenforceable, r)
+			continue
+		}
+		enforceable = append(enforceable, r)
+	}
+	return enforceable, unenforceable
+}
+
+// renderNftables renders a table that drops connections to each port of
+// each VIP with source ranges from outside of them.
+func renderNftables(cfg *config) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# generated by %s, do not edit\n", eventSourceComponent)
+	fmt.Fprintf(&b, "table inet %s\n", strings.ToLower(firewallChain))
+	fmt.Fprintf(&b, "delete table inet %s\n", strings.ToLower(firewallChain))
+	fmt.Fprintf(&b, "table inet %s {\n", strings.ToLower(firewallChain))
+	fmt.Fprintf(&b, "    chain input {\n")
+	fmt.Fprintf(&b, "        type filter hook input priority 0; policy accept;\n")
+	for _, s := range cfg.Services {
+		ranges, _ := enforceableRanges(s)
+		if len(ranges) == 0 {
+			continue
+		}
+		family := "ip"
+		if net.ParseIP(s.IP).To4() == nil {
+			family = "ip6"
+		}
+		for _, p := range s.Ports {
+			fmt.Fprintf(&b, "        %s daddr %s %s dport %d %s saddr != { %s } drop # %s/%s\n",
+				family, s.IP, strings.ToLower(p.Protocol), p.Port, family, strings.Join(ranges, ", "), s.ServiceNamespace, s.ServiceName)
+		}
+	}
+	fmt.Fprintf(&b, "    }\n")
+	fmt.Fprintf(&b, "}\n")
+	return b.String()
+}
+
+// renderIptables renders a chain that returns for connections to each port
+// of each VIP with source ranges from within them, and drops the rest. The
+// chain must be jumped to from the INPUT chain.
+func renderIptables(cfg *config) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# generated by %s, do not edit\n", eventSourceComponent)
+	fmt.Fprintf(&b, "*filter\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", firewallChain)
+	for _, s := range cfg.Services {
+		ranges, _ := enforceableRanges(s)
+		if len(ranges) == 0 || net.ParseIP(s.IP).To4() == nil {
+			continue
+		}
+		for _, p := range s.Ports {
+			proto := strings.ToLower(p.Protocol)
+			for _, r := range ranges {
+				fmt.Fprintf(&b, "-A %s -d %s/32 -p %s --dport %d -s %s -m comment --comment \"%s/%s\" -j RETURN\n",
+					firewallChain, s.IP, proto, p.Port, r, s.ServiceNamespace, s.ServiceName)
+			}
+			fmt.Fprintf(&b, "-A %s -d %s/32 -p %s --dport %d -m comment --comment \"%s/%s\" -j DROP\n",
+				firewallChain, s.IP, proto, p.Port, s.ServiceNamespace, s.ServiceName)
+		}
+	}
+	fmt.Fprintf(&b, "COMMIT\n")
+	return b.String()
+}
+
+// unenforced returns the source ranges of sc that are not enforced by f,
+// which may be nil if no firewall is configured. Rules are per port, so none
+// of the ranges of a service without ports are enforced.
+func (f *firewall) unenforced(sc serviceConfig) []string {
+	if f == nil || len(sc.Ports) == 0 {
+		return sc.SourceRanges
+	}
+	enforceable, unenforceable := enforceableRanges(sc)
+	if f.format == firewallFormatIptables && net.ParseIP(sc.IP).To4() == nil {
+		return append(enforceable, unenforceable...)
+	}
+	return unenforceable
+}
+
+// reportUnenforcedRanges records an event against service if any of the
+// source ranges of sc are not enforced.
+func (k *KeepalivedLoadBalancer) reportUnenforcedRanges(service *v1.Service, sc serviceConfig) {
+	ranges := k.firewall.unenforced(sc)
+	if len(ranges) == 0 {
+		return
+	}
+	reason := "no firewall is configured"
+	switch {
+	case k.firewall == nil:
+	case len(sc.Ports) == 0:
+		reason = "the service has no ports to apply them to"
+	default:
+		reason = fmt.Sprintf("they cannot be applied to vip %s", sc.IP)
+	}
+	glog.Warningf("source ranges %s of service '%s/%s' are not enforced: %s", strings.Join(ranges, ", "), service.Namespace, service.Name, reason)
+	k.recordEventf(service, apiv1.EventTypeWarning, eventReasonSourceRangesNotEnforced, "Source ranges %s are not enforced: %s", strings.Join(ranges, ", "), reason)
+}
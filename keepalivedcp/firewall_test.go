@@ -0,0 +1,68 @@
+package keepalivedcp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var firewallTestConfig = &config{
+	Services: []serviceConfig{
+		{
+			IP:               "10.0.0.1",
+			ServiceNamespace: "default",
+			ServiceName:      "web",
+			Ports:            []servicePort{{Protocol: "TCP", Port: 443}},
+			SourceRanges:     []string{"192.168.0.0/16", "fd00::/8"},
+		},
+		{
+			IP:               "10.0.0.2",
+			ServiceNamespace: "default",
+			ServiceName:      "open",
+			Ports:            []servicePort{{Protocol: "TCP", Port: 80}},
+		},
+	},
+}
+
+func TestRenderNftables(t *testing.T) {
+	rules := renderNftables(firewallTestConfig)
+
+	expected := "        ip daddr 10.0.0.1 tcp dport 443 ip saddr != { 192.168.0.0/16 } drop # default/web\n"
+	if !strings.Contains(rules, expected) {
+		t.Errorf("expected rules to contain %q but got:\n%s", expected, rules)
+	}
+	if strings.Contains(rules, "10.0.0.2") {
+		t.Errorf("expected no rules for service without source ranges but got:\n%s", rules)
+	}
+}
+
+func TestRenderIptables(t *testing.T) {
+	rules := renderIptables(firewallTestConfig)
+
+	expected := `-A KEEPALIVED-SOURCE-RANGES -d 10.0.0.1/32 -p tcp --dport 443 -s 192.168.0.0/16 -m comment --comment "default/web" -j RETURN
+-A KEEPALIVED-SOURCE-RANGES -d 10.0.0.1/32 -p tcp --dport 443 -m comment --comment "default/web" -j DROP
+COMMIT
+`
+	if !strings.HasSuffix(rules, expected) {
+		t.Errorf("expected rules to end with:\n%s\nbut got:\n%s", expected, rules)
+	}
+}
+
+func TestUnenforcedRanges(t *testing.T) {
+	sc := firewallTestConfig.Services[0]
+
+	var none *firewall
+	if ranges := none.unenforced(sc); !reflect.DeepEqual(ranges, sc.SourceRanges) {
+		t.Errorf("expected all ranges to be unenforced without a firewall but got %v", ranges)
+	}
+
+	f := &firewall{format: firewallFormatNftables}
+	if ranges := f.unenforced(sc); !reflect.DeepEqual(ranges, []string{"fd00::/8"}) {
+		t.Errorf("expected ipv6 range to be unenforced for ipv4 vip but got %v", ranges)
+	}
+
+	sc.Ports = nil
+	if ranges := f.unenforced(sc); !reflect.DeepEqual(ranges, sc.SourceRanges) {
+		t.Errorf("expected all ranges to be unenforced without ports but got %v", ranges)
+	}
+}
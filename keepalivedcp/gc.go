@@ -0,0 +1,163 @@
+package keepalivedcp
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// orphanCollector periodically releases allocations in the config whose
+// service no longer exists, or is no longer of type LoadBalancer. This covers
+// services for which EnsureLoadBalancerDeleted was never called, eg. because
+// the controller was down when they were deleted.
+//
+// Every replica of the controller runs a collector. Updates to the ConfigMap
+// are made against the resourceVersion that was read, so concurrent
+// collectors cannot overwrite each other's changes.
+type orphanCollector struct {
+	lb *KeepalivedLoadBalancer
+	// gracePeriod is how long an allocation must have been orphaned for
+	// before it is released, so that services that are synced between
+	// listing services and reading the config are not released
+	gracePeriod time.Duration
+	// dryRun causes orphans to be reported but not released
+	dryRun bool
+
+	// orphanedSince records when each orphaned UID was first seen
+	orphanedSince map[string]time.Time
+	now           func() time.Time
+
+	// listServices, getConfigMap and updateConfigMap read services and
+	// the ConfigMap from, and write the ConfigMap back to, the API server
+	listServices    func() ([]apiv1.Service, error)
+	getConfigMap    func() (*apiv1.ConfigMap, error)
+	updateConfigMap func(*apiv1.ConfigMap, *config) error
+}
+
+func newOrphanCollector(lb *KeepalivedLoadBalancer, gracePeriod time.Duration, dryRun bool) *orphanCollector {
+	o := &orphanCollector{
+		lb:              lb,
+		gracePeriod:     gracePeriod,
+		dryRun:          dryRun,
+		orphanedSince:   map[string]time.Time{},
+		now:             time.Now,
+		getConfigMap:    lb.getConfigMap,
+		updateConfigMap: lb.updateConfigMap,
+	}
+	o.listServices = o.listAllServices
+	return o
+}
+
+func (o *orphanCollector) listAllServices() ([]apiv1.Service, error) {
+	svcs, err := o.lb.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return svcs.Items, nil
+}
+
+// Run collects orphans every interval until stopCh is closed.
+func (o *orphanCollector) Run(interval time.Duration, stopCh <-chan struct{}) {
+	glog.Infof("collecting orphaned allocations every %s with grace period %s (dry run: %t)", interval, o.gracePeriod, o.dryRun)
+	wait.Until(func() {
+		if err := o.collect(); err != nil {
+			glog.Errorf("error collecting orphaned allocations: %s", err.Error())
+		}
+	}, interval, stopCh)
+}
+
+func (o *orphanCollector) collect() error {
+	svcs, err := o.listServices()
+
+	if err != nil {
+		return err
+	}
+
+	live := make(map[string]bool, len(svcs))
+	for _, svc := range svcs {
+		if svc.Spec.Type == apiv1.ServiceTypeLoadBalancer {
+			live[string(svc.UID)] = true
+		}
+	}
+
+	cm, err := o.getConfigMap()
+
+	if err != nil {
+		return err
+	}
+
+	cfg, err := configFrom(cm)
+
+	if err != nil {
+		return err
+	}
+
+	orphans := o.expiredOrphans(cfg, live)
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	for _, svc := range orphans {
+		if o.dryRun {
+			glog.Infof("dry run: would release orphaned allocation for service '%s/%s' (%s): %s", svc.ServiceNamespace, svc.ServiceName, svc.UID, svc.IP)
+			continue
+		}
+		glog.Infof("releasing orphaned allocation for service '%s/%s' (%s): %s", svc.ServiceNamespace, svc.ServiceName, svc.UID, svc.IP)
+		if err := o.lb.releaseService(cm, cfg, svc); err != nil {
+			return err
+		}
+	}
+
+	if o.dryRun {
+		return nil
+	}
+
+	if err := o.updateConfigMap(cm, cfg); err != nil {
+		return err
+	}
+
+	for _, svc := range orphans {
+		delete(o.orphanedSince, svc.UID)
+	}
+
+	return nil
+}
+
+// expiredOrphans returns the services in cfg that are not in live and have
+// been orphaned for longer than the grace period. UIDs that are no longer
+// orphaned are forgotten.
+func (o *orphanCollector) expiredOrphans(cfg *config, live map[string]bool) []serviceConfig {
+	now := o.now()
+	seen := make(map[string]bool, len(cfg.Services))
+	var expired []serviceConfig
+
+	for _, svc := range cfg.Services {
+		if live[svc.UID] {
+			continue
+		}
+		seen[svc.UID] = true
+
+		since, ok := o.orphanedSince[svc.UID]
+		if !ok {
+			glog.Infof("allocation for service '%s/%s' (%s) is orphaned: %s", svc.ServiceNamespace, svc.ServiceName, svc.UID, svc.IP)
+			o.orphanedSince[svc.UID] = now
+			continue
+		}
+
+		if now.Sub(since) >= o.gracePeriod {
+			expired = append(expired, svc)
+		}
+	}
+
+	for uid := range o.orphanedSince {
+		if !seen[uid] {
+			delete(o.orphanedSince, uid)
+		}
+	}
+
+	return expired
+}
@@ -0,0 +1,171 @@
+package keepalivedcp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestExpiredOrphans(t *testing.T) {
+	cfg := &config{
+		Services: []serviceConfig{
+			{UID: "live", IP: "10.0.0.1"},
+			{UID: "orphan", IP: "10.0.0.2"},
+		},
+	}
+	live := map[string]bool{"live": true}
+
+	now := time.Unix(0, 0)
+	o := newOrphanCollector(nil, time.Minute, false)
+	o.now = func() time.Time { return now }
+
+	if expired := o.expiredOrphans(cfg, live); len(expired) != 0 {
+		t.Errorf("expected no expired orphans when first seen but got %v", expired)
+	}
+
+	now = now.Add(30 * time.Second)
+	if expired := o.expiredOrphans(cfg, live); len(expired) != 0 {
+		t.Errorf("expected no expired orphans within grace period but got %v", expired)
+	}
+
+	now = now.Add(30 * time.Second)
+	expired := o.expiredOrphans(cfg, live)
+	if len(expired) != 1 || expired[0].UID != "orphan" {
+		t.Errorf("expected orphan to have expired but got %v", expired)
+	}
+
+	// the service reappearing resets the grace period
+	live["orphan"] = true
+	o.expiredOrphans(cfg, live)
+	if _, ok := o.orphanedSince["orphan"]; ok {
+		t.Errorf("expected live service to be forgotten")
+	}
+}
+
+func TestOrphanCollectorCollect(t *testing.T) {
+	type step struct {
+		// at is the time of the run, after the first
+		at   time.Duration
+		live []string
+		// allocated are the UIDs allocated in the ConfigMap after the run
+		allocated []string
+	}
+	type testDef struct {
+		name   string
+		dryRun bool
+		steps  []step
+	}
+
+	tests := []testDef{
+		{
+			name: "grace period",
+			steps: []step{
+				{at: 0, live: []string{"a"}, allocated: []string{"a", "b", "c"}},
+				{at: 30 * time.Second, live: []string{"a"}, allocated: []string{"a", "b", "c"}},
+				// c comes back before its grace period expires, and is
+				// orphaned again with a new grace period
+				{at: 45 * time.Second, live: []string{"a", "c"}, allocated: []string{"a", "b", "c"}},
+				{at: 61 * time.Second, live: []string{"a"}, allocated: []string{"a", "c"}},
+				{at: 90 * time.Second, live: []string{"a"}, allocated: []string{"a", "c"}},
+				{at: 121 * time.Second, live: []string{"a"}, allocated: []string{"a"}},
+			},
+		},
+		{
+			name:   "dry run",
+			dryRun: true,
+			steps: []step{
+				{at: 0, live: []string{"a"}, allocated: []string{"a", "b", "c"}},
+				{at: 61 * time.Second, live: []string{"a"}, allocated: []string{"a", "b", "c"}},
+				{at: 121 * time.Second, live: []string{"a"}, allocated: []string{"a", "b", "c"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				cfg := &config{
+					Version: currentConfigVersion,
+					Services: []serviceConfig{
+						{UID: "a", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "a"},
+						{UID: "b", IP: "10.0.0.2", ServiceNamespace: "default", ServiceName: "b"},
+						{UID: "c", IP: "10.0.0.3", ServiceNamespace: "default", ServiceName: "c"},
+					},
+				}
+				cfgBytes, err := cfg.encode()
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+				stored := &apiv1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{configMapAnnotationKey: string(cfgBytes)}},
+					Data:       cfg.toConfigMapData(),
+				}
+
+				var now time.Time
+				var live []string
+				o := newOrphanCollector(NewKeepalivedLoadBalancer(nil, nil, "", "", "", "", ""), time.Minute, test.dryRun)
+				o.now = func() time.Time { return now }
+				o.listServices = func() ([]apiv1.Service, error) {
+					var svcs []apiv1.Service
+					for _, uid := range live {
+						svcs = append(svcs, apiv1.Service{
+							ObjectMeta: metav1.ObjectMeta{UID: types.UID(uid)},
+							Spec:       apiv1.ServiceSpec{Type: apiv1.ServiceTypeLoadBalancer},
+						})
+					}
+					return svcs, nil
+				}
+				o.getConfigMap = func() (*apiv1.ConfigMap, error) {
+					cm := *stored
+					cm.Data = make(map[string]string, len(stored.Data))
+					for k, v := range stored.Data {
+						cm.Data[k] = v
+					}
+					return &cm, nil
+				}
+				o.updateConfigMap = func(cm *apiv1.ConfigMap, cfg *config) error {
+					if test.dryRun {
+						t.Errorf("unexpected update in dry run")
+					}
+					cfgBytes, err := cfg.encode()
+					if err != nil {
+						return err
+					}
+					cm.Annotations = map[string]string{configMapAnnotationKey: string(cfgBytes)}
+					stored = cm
+					return nil
+				}
+
+				start := time.Unix(0, 0)
+				for _, s := range test.steps {
+					now, live = start.Add(s.at), s.live
+					if err := o.collect(); err != nil {
+						t.Fatalf("unexpected error at %s: %s", s.at, err.Error())
+					}
+
+					cfg, err := configFrom(stored)
+					if err != nil {
+						t.Fatalf("unexpected error: %s", err.Error())
+					}
+					var allocated []string
+					for _, svc := range cfg.Services {
+						allocated = append(allocated, svc.UID)
+						if _, ok := stored.Data[svc.IP]; !ok {
+							t.Errorf("expected data for %s at %s", svc.IP, s.at)
+						}
+					}
+					if !reflect.DeepEqual(allocated, s.allocated) {
+						t.Errorf("expected allocations %v at %s but got %v", s.allocated, s.at, allocated)
+					}
+					if len(stored.Data) != len(s.allocated) {
+						t.Errorf("expected %d data entries at %s but got %v", len(s.allocated), s.at, stored.Data)
+					}
+				}
+			}
+		}(test))
+	}
+}
@@ -0,0 +1,99 @@
+package keepalivedcp
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// haproxyConfKey is the key of the rendered haproxy.cfg.
+const haproxyConfKey = "haproxy.cfg"
+
+// renderHAProxy renders the frontend and backend sections of a haproxy.cfg
+// for the TCP ports of services. Each VIP and port is bound by a frontend,
+// forwarding to a backend per service with the nodes as servers on the
+// port's NodePort. haproxy must be allowed to bind VIPs that are not held by
+// the node, eg. with the net.ipv4.ip_nonlocal_bind sysctl.
+func renderHAProxy(services []serviceConfig, nodes []string) string {
+	var b bytes.Buffer
+	for _, l := range listeners(services) {
+		writeHAProxyFrontend(&b, l)
+		for _, s := range l.Services {
+			writeHAProxyBackend(&b, s, nodes)
+		}
+	}
+	return b.String()
+}
+
+func writeHAProxyFrontend(b *bytes.Buffer, l listener) {
+	fmt.Fprintf(b, "frontend %s\n", l.name())
+	fmt.Fprintf(b, "    mode tcp\n")
+	fmt.Fprintf(b, "    bind %s:%d\n", l.IP, l.Port)
+	if l.routed() {
+		fmt.Fprintf(b, "    tcp-request inspect-delay 5s\n")
+		fmt.Fprintf(b, "    tcp-request content accept if { req_ssl_hello_type 1 }\n")
+		for _, s := range l.Services {
+			for _, h := range s.SNIHostnames {
+				if strings.HasPrefix(h, "*.") {
+					fmt.Fprintf(b, "    use_backend %s if { req_ssl_sni -i -m end %s }\n", s.name(), h[1:])
+					continue
+				}
+				fmt.Fprintf(b, "    use_backend %s if { req_ssl_sni -i %s }\n", s.name(), h)
+			}
+		}
+	}
+	if s, ok := l.defaultService(); ok {
+		fmt.Fprintf(b, "    default_backend %s\n", s.name())
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+func writeHAProxyBackend(b *bytes.Buffer, s listenerService, nodes []string) {
+	hc := defaultHealthCheck
+	if s.HealthCheck != nil {
+		hc = *s.HealthCheck
+	}
+
+	fmt.Fprintf(b, "# %s/%s %d/%s\n", s.ServiceNamespace, s.ServiceName, s.Port.Port, s.Port.Protocol)
+	fmt.Fprintf(b, "backend %s\n", s.name())
+	fmt.Fprintf(b, "    mode tcp\n")
+	fmt.Fprintf(b, "    balance %s\n", haproxyBalance(s.Scheduler))
+
+	check := ""
+	switch hc.Type {
+	case healthCheckHTTP, healthCheckSSL:
+		fmt.Fprintf(b, "    option httpchk GET %s\n", hc.path())
+		fmt.Fprintf(b, "    http-check expect status %d\n", hc.status())
+		check = fmt.Sprintf(" check inter %ds fall %d", hc.interval(), hc.retries())
+		if hc.Type == healthCheckSSL {
+			check += " check-ssl verify none"
+		}
+	case healthCheckTCP:
+		check = fmt.Sprintf(" check inter %ds fall %d", hc.interval(), hc.retries())
+	}
+
+	sendProxy := ""
+	switch s.ProxyProtocol {
+	case proxyProtocolV1:
+		sendProxy = " send-proxy"
+	case proxyProtocolV2:
+		sendProxy = " send-proxy-v2"
+	}
+
+	for i, n := range nodes {
+		fmt.Fprintf(b, "    server node%d %s:%d%s%s\n", i, n, s.Port.NodePort, sendProxy, check)
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+// haproxyBalance returns the haproxy balance algorithm closest to an IPVS
+// scheduler.
+func haproxyBalance(scheduler string) string {
+	switch scheduler {
+	case "lc", "wlc", "lblc":
+		return "leastconn"
+	case "sh", "mh", "dh":
+		return "source"
+	}
+	return "roundrobin"
+}
@@ -0,0 +1,188 @@
+package keepalivedcp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeepalivedRendererProxyProtocol(t *testing.T) {
+	cfg := &config{
+		Services: []serviceConfig{
+			{
+				UID:              "a",
+				IP:               "10.0.0.1",
+				ServiceNamespace: "ingress",
+				ServiceName:      "nginx",
+				ProxyProtocol:    "v2",
+				Scheduler:        "lc",
+				Ports: []servicePort{
+					{Protocol: "TCP", Port: 443, NodePort: 30443},
+				},
+			},
+			{
+				UID:              "b",
+				IP:               "10.0.0.2",
+				ServiceNamespace: "default",
+				ServiceName:      "ipvs",
+				Ports: []servicePort{
+					{Protocol: "TCP", Port: 80, NodePort: 30080},
+				},
+			},
+		},
+		Nodes: []string{"192.168.0.1", "192.168.0.2"},
+	}
+
+	expected := `frontend vip_10.0.0.1_443
+    mode tcp
+    bind 10.0.0.1:443
+    default_backend ingress_nginx_443
+
+# ingress/nginx 443/TCP
+backend ingress_nginx_443
+    mode tcp
+    balance leastconn
+    server node0 192.168.0.1:30443 send-proxy-v2 check inter 5s fall 3
+    server node1 192.168.0.2:30443 send-proxy-v2 check inter 5s fall 3
+
+`
+
+	data, err := keepalivedRenderer{}.render(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if out := data[haproxyConfKey]; out != expected {
+		t.Errorf("expected haproxy.cfg:\n%s\nbut got:\n%s", expected, out)
+	}
+
+	if conf := data[keepalivedConfKey]; conf == "" || strings.Contains(conf, "10.0.0.1") {
+		t.Errorf("expected keepalived.conf to only contain ipvs service but got:\n%s", conf)
+	}
+
+	if v := cfg.Services[0].configMapValue(); v != "ingress/nginx:PROXY" {
+		t.Errorf("unexpected configmap value '%s'", v)
+	}
+}
+
+func TestRenderHAProxySNI(t *testing.T) {
+	services := []serviceConfig{
+		{
+			UID:              "a",
+			IP:               "10.0.0.1",
+			ServiceNamespace: "tenant-a",
+			ServiceName:      "web",
+			SNIHostnames:     []string{"a.example.com"},
+			HealthCheck:      &healthCheck{Type: healthCheckHTTP, Path: "/healthz"},
+			Ports:            []servicePort{{Protocol: "TCP", Port: 443, NodePort: 30001}},
+		},
+		{
+			UID:              "b",
+			IP:               "10.0.0.1",
+			ServiceNamespace: "tenant-b",
+			ServiceName:      "web",
+			SNIHostnames:     []string{"*.b.example.com"},
+			HealthCheck:      &healthCheck{Type: healthCheckNone},
+			Ports:            []servicePort{{Protocol: "TCP", Port: 443, NodePort: 30002}},
+		},
+	}
+
+	expected := `frontend vip_10.0.0.1_443
+    mode tcp
+    bind 10.0.0.1:443
+    tcp-request inspect-delay 5s
+    tcp-request content accept if { req_ssl_hello_type 1 }
+    use_backend tenant-a_web_443 if { req_ssl_sni -i a.example.com }
+    use_backend tenant-b_web_443 if { req_ssl_sni -i -m end .b.example.com }
+
+# tenant-a/web 443/TCP
+backend tenant-a_web_443
+    mode tcp
+    balance roundrobin
+    option httpchk GET /healthz
+    http-check expect status 200
+    server node0 192.168.0.1:30001 check inter 5s fall 3
+
+# tenant-b/web 443/TCP
+backend tenant-b_web_443
+    mode tcp
+    balance roundrobin
+    server node0 192.168.0.1:30002
+
+`
+
+	if out := renderHAProxy(services, []string{"192.168.0.1"}); out != expected {
+		t.Errorf("expected haproxy.cfg:\n%s\nbut got:\n%s", expected, out)
+	}
+}
+
+func TestCheckSharing(t *testing.T) {
+	type testDef struct {
+		name   string
+		format string
+		sc     serviceConfig
+		err    bool
+	}
+
+	https := []servicePort{{Protocol: "TCP", Port: 443}}
+	cfg := &config{
+		Services: []serviceConfig{
+			{UID: "1", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "a", Ports: https, SNIHostnames: []string{"a.example.com"}},
+			{UID: "2", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "default", Ports: https},
+		},
+	}
+
+	tests := []testDef{
+		{
+			name:   "new sni hostname",
+			format: configFormatHAProxy,
+			sc:     serviceConfig{UID: "3", IP: "10.0.0.1", Ports: https, SNIHostnames: []string{"b.example.com"}},
+		},
+		{
+			name:   "sni hostname already claimed",
+			format: configFormatHAProxy,
+			sc:     serviceConfig{UID: "3", IP: "10.0.0.1", Ports: https, SNIHostnames: []string{"a.example.com"}},
+			err:    true,
+		},
+		{
+			name:   "second default service",
+			format: configFormatHAProxy,
+			sc:     serviceConfig{UID: "3", IP: "10.0.0.1", Ports: https},
+			err:    true,
+		},
+		{
+			name:   "existing default service",
+			format: configFormatEnvoy,
+			sc:     serviceConfig{UID: "2", IP: "10.0.0.1", Ports: https},
+		},
+		{
+			name:   "other port",
+			format: configFormatHAProxy,
+			sc:     serviceConfig{UID: "3", IP: "10.0.0.1", Ports: []servicePort{{Protocol: "TCP", Port: 80}}},
+		},
+		{
+			name:   "vip format",
+			format: configFormatVIP,
+			sc:     serviceConfig{UID: "3", IP: "10.0.0.1", Ports: []servicePort{{Protocol: "TCP", Port: 80}}},
+			err:    true,
+		},
+		{
+			name:   "other vip",
+			format: configFormatVIP,
+			sc:     serviceConfig{UID: "3", IP: "10.0.0.2", Ports: https},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				k := &KeepalivedLoadBalancer{configFormat: test.format}
+				err := k.checkSharing(cfg, test.sc)
+				if err != nil && !test.err {
+					t.Errorf("unexpected error: %s", err.Error())
+				}
+				if err == nil && test.err {
+					t.Errorf("expected error but got none")
+				}
+			}
+		}(test))
+	}
+}
@@ -0,0 +1,119 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+const (
+	healthCheckTCP  = "TCP_CHECK"
+	healthCheckHTTP = "HTTP_GET"
+	healthCheckSSL  = "SSL_GET"
+	healthCheckMisc = "MISC_CHECK"
+	// healthCheckNone disables health checking of real servers
+	healthCheckNone = "NONE"
+)
+
+var validHealthChecks = map[string]bool{
+	healthCheckTCP:  true,
+	healthCheckHTTP: true,
+	healthCheckSSL:  true,
+	healthCheckMisc: true,
+	healthCheckNone: true,
+}
+
+const (
+	defaultHealthCheckInterval = 5
+	defaultHealthCheckRetries  = 3
+	defaultHealthCheckTimeout  = 3
+	defaultHealthCheckPath     = "/"
+	defaultHealthCheckStatus   = 200
+)
+
+// defaultHealthCheck is used for services that do not configure a health
+// check, and checks that a TCP connection can be made to each NodePort.
+var defaultHealthCheck = healthCheck{Type: healthCheckTCP}
+
+// healthCheck describes the check keepalived performs against each real
+// server of a service. Zero values are replaced with defaults when rendered.
+type healthCheck struct {
+	Type string `json:"type"`
+	// Path is the URL path for HTTP_GET and SSL_GET checks, or the script to
+	// run for MISC_CHECK
+	Path     string `json:"path,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Interval int    `json:"interval,omitempty"`
+	Retries  int    `json:"retries,omitempty"`
+}
+
+// appliesTo returns true if the check can be performed against a port using
+// protocol. Only MISC_CHECK, which runs an arbitrary script, can check UDP
+// ports.
+func (hc healthCheck) appliesTo(protocol string) bool {
+	switch hc.Type {
+	case healthCheckNone:
+		return false
+	case healthCheckMisc:
+		return true
+	}
+	return protocol == "TCP"
+}
+
+func (hc healthCheck) interval() int {
+	if hc.Interval == 0 {
+		return defaultHealthCheckInterval
+	}
+	return hc.Interval
+}
+
+func (hc healthCheck) retries() int {
+	if hc.Retries == 0 {
+		return defaultHealthCheckRetries
+	}
+	return hc.Retries
+}
+
+func (hc healthCheck) path() string {
+	if hc.Path == "" {
+		return defaultHealthCheckPath
+	}
+	return hc.Path
+}
+
+func (hc healthCheck) status() int {
+	if hc.Status == 0 {
+		return defaultHealthCheckStatus
+	}
+	return hc.Status
+}
+
+// urlPathPattern matches an absolute URL path, with an optional query, that
+// can be written into keepalived, haproxy and envoy configs without quoting.
+var urlPathPattern = regexp.MustCompile(`^/[A-Za-z0-9._~!$&()*+,=:@%/?-]*$`)
+
+func validURLPath(p string) bool {
+	return urlPathPattern.MatchString(p)
+}
+
+// validateHealthCheckScripts checks that the MISC_CHECK scripts allowed in the
+// cloud config are absolute paths that can be written into keepalived.conf.
+func validateHealthCheckScripts(scripts []string) error {
+	for _, s := range scripts {
+		if !path.IsAbs(s) || !validURLPath(s) || path.Clean(s) != s {
+			return fmt.Errorf("invalid health check script '%s': must be a clean absolute path", s)
+		}
+	}
+	return nil
+}
+
+// allowedHealthCheckScript returns true if script is one of the MISC_CHECK
+// scripts allowed in the cloud config.
+func (k *KeepalivedLoadBalancer) allowedHealthCheckScript(script string) bool {
+	for _, s := range k.healthCheckScripts {
+		if s == script {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package keepalivedcp
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+const serviceHostnameAnnotationKey = "k8s.co/keepalived-hostname"
+
+// hostnameSentinel is the name the hostname template is executed with to
+// find the domain of a namespace, which is what follows it.
+const hostnameSentinel = "keepalived-hostname-sentinel"
+
+// hostnameTemplateData is the data hostname templates are executed with.
+type hostnameTemplateData struct {
+	Name      string
+	Namespace string
+}
+
+// parseHostnameTemplate parses the hostname template set in the cloud
+// config, eg. {{.Name}}.{{.Namespace}}.lb.example.com.
+func parseHostnameTemplate(text string) (*template.Template, error) {
+	t, err := template.New("hostname").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hostname template '%s': %s", text, err.Error())
+	}
+	if _, err := executeHostnameTemplate(t, hostnameTemplateData{Name: "name", Namespace: "namespace"}); err != nil {
+		return nil, fmt.Errorf("invalid hostname template '%s': %s", text, err.Error())
+	}
+	return t, nil
+}
+
+func executeHostnameTemplate(t *template.Template, data hostnameTemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	h := strings.ToLower(buf.String())
+	if !validHostname(h) {
+		return "", fmt.Errorf("'%s' is not a valid hostname", h)
+	}
+	return h, nil
+}
+
+// hostnameFor returns the hostname of service, from its annotation or the
+// hostname template, or an empty string if it has neither. When hostnames are
+// published to DNS, a hostname in the annotation must be within the domain of
+// the service's namespace, so that a tenant cannot take over the hostnames of
+// another.
+func (k *KeepalivedLoadBalancer) hostnameFor(service *v1.Service) (string, error) {
+	if h, ok := service.Annotations[serviceHostnameAnnotationKey]; ok {
+		h = strings.ToLower(strings.TrimSuffix(h, "."))
+		if !validHostname(h) {
+			return "", fmt.Errorf("invalid hostname '%s' in annotation %s", h, serviceHostnameAnnotationKey)
+		}
+		if !k.restrictHostnames {
+			return h, nil
+		}
+		domain, err := k.namespaceDomain(service.Namespace)
+		if err != nil {
+			return "", fmt.Errorf("annotation %s cannot be used: %s", serviceHostnameAnnotationKey, err.Error())
+		}
+		if h != domain && !strings.HasSuffix(h, "."+domain) {
+			return "", fmt.Errorf("hostname '%s' in annotation %s is not within the domain '%s' of namespace '%s'", h, serviceHostnameAnnotationKey, domain, service.Namespace)
+		}
+		return h, nil
+	}
+
+	if k.hostnameTemplate == nil {
+		return "", nil
+	}
+	h, err := executeHostnameTemplate(k.hostnameTemplate, hostnameTemplateData{Name: service.Name, Namespace: service.Namespace})
+	if err != nil {
+		return "", fmt.Errorf("error generating hostname: %s", err.Error())
+	}
+	return h, nil
+}
+
+// namespaceDomain returns the domain that the hostnames of the services in
+// namespace are generated in by the hostname template, ie. what follows the
+// first label of their hostnames. An error is returned if there is no
+// template, or it does not generate hostnames of the form <name>.<domain>
+// with a domain of their own for each namespace.
+func (k *KeepalivedLoadBalancer) namespaceDomain(namespace string) (string, error) {
+	if k.hostnameTemplate == nil {
+		return "", fmt.Errorf("no hostname template is configured to restrict hostnames to their namespace")
+	}
+
+	domainOf := func(namespace string) (string, error) {
+		h, err := executeHostnameTemplate(k.hostnameTemplate, hostnameTemplateData{Name: hostnameSentinel, Namespace: namespace})
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(h, hostnameSentinel+".") {
+			return "", fmt.Errorf("the hostname template does not generate hostnames of the form <name>.<domain>")
+		}
+		return strings.TrimPrefix(h, hostnameSentinel+"."), nil
+	}
+
+	domain, err := domainOf(namespace)
+	if err != nil {
+		return "", err
+	}
+	other, err := domainOf(namespace + "-" + hostnameSentinel)
+	if err != nil {
+		return "", err
+	}
+	if domain == other {
+		return "", fmt.Errorf("the hostname template does not generate a domain for each namespace")
+	}
+	return domain, nil
+}
+
+// checkHostname returns an error if the hostname of sc is already used by
+// another service in cfg.
+func checkHostname(cfg *config, sc serviceConfig) error {
+	if sc.Hostname == "" {
+		return nil
+	}
+	for _, s := range cfg.Services {
+		if s.Hostname == sc.Hostname && s.UID != sc.UID {
+			return fmt.Errorf("hostname '%s' is already used by service %s/%s", sc.Hostname, s.ServiceNamespace, s.ServiceName)
+		}
+	}
+	return nil
+}
+
+// validHostname returns true if h is a lower case DNS name, without a
+// trailing dot, made up of letters, digits and hyphens.
+func validHostname(h string) bool {
+	if h == "" || len(h) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(h, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
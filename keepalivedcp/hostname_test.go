@@ -0,0 +1,172 @@
+package keepalivedcp
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+func TestHostnameFor(t *testing.T) {
+	type testDef struct {
+		name        string
+		template    string
+		dns         bool
+		annotations map[string]string
+		expected    string
+		err         bool
+	}
+
+	tests := []testDef{
+		{
+			name: "no template or annotation",
+		},
+		{
+			name:     "template",
+			template: "{{.Name}}.{{.Namespace}}.lb.example.com",
+			expected: "web.default.lb.example.com",
+		},
+		{
+			name:     "annotation overrides template",
+			template: "{{.Name}}.{{.Namespace}}.lb.example.com",
+			dns:      true,
+			annotations: map[string]string{
+				serviceHostnameAnnotationKey: "WWW.default.lb.example.com.",
+			},
+			expected: "www.default.lb.example.com",
+		},
+		{
+			name:     "annotation outside namespace domain",
+			template: "{{.Name}}.{{.Namespace}}.lb.example.com",
+			dns:      true,
+			annotations: map[string]string{
+				serviceHostnameAnnotationKey: "web.other.lb.example.com",
+			},
+			err: true,
+		},
+		{
+			name:     "annotation outside namespace domain without dns",
+			template: "{{.Name}}.{{.Namespace}}.lb.example.com",
+			annotations: map[string]string{
+				serviceHostnameAnnotationKey: "web.other.lb.example.com",
+			},
+			expected: "web.other.lb.example.com",
+		},
+		{
+			name: "annotation without template or dns",
+			annotations: map[string]string{
+				serviceHostnameAnnotationKey: "www.example.com",
+			},
+			expected: "www.example.com",
+		},
+		{
+			name: "annotation without template with dns",
+			dns:  true,
+			annotations: map[string]string{
+				serviceHostnameAnnotationKey: "www.example.com",
+			},
+			err: true,
+		},
+		{
+			name: "invalid annotation without dns",
+			annotations: map[string]string{
+				serviceHostnameAnnotationKey: "www..example.com",
+			},
+			err: true,
+		},
+		{
+			name:     "annotation with template without namespace domain",
+			template: "{{.Name}}-{{.Namespace}}.lb.example.com",
+			dns:      true,
+			annotations: map[string]string{
+				serviceHostnameAnnotationKey: "www.lb.example.com",
+			},
+			err: true,
+		},
+		{
+			name:     "annotation with template shared by namespaces",
+			template: "{{.Name}}.lb.example.com",
+			dns:      true,
+			annotations: map[string]string{
+				serviceHostnameAnnotationKey: "www.lb.example.com",
+			},
+			err: true,
+		},
+		{
+			name:     "template generates invalid hostname",
+			template: "{{.Name}}..lb.example.com",
+			err:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				k := &KeepalivedLoadBalancer{restrictHostnames: test.dns}
+				if test.template != "" {
+					tmpl, err := parseHostnameTemplate(test.template)
+					if err != nil {
+						if test.err {
+							return
+						}
+						t.Errorf("got error parsing template: %s", err.Error())
+						return
+					}
+					k.hostnameTemplate = tmpl
+				}
+				svc := &v1.Service{}
+				svc.Name, svc.Namespace = "web", "default"
+				svc.Annotations = test.annotations
+
+				h, err := k.hostnameFor(svc)
+
+				if err != nil {
+					if test.err {
+						return
+					}
+
+					t.Errorf("got error: %s", err.Error())
+					return
+				}
+
+				if test.err {
+					t.Errorf("expected error but got none")
+					return
+				}
+
+				if h != test.expected {
+					t.Errorf("expected hostname '%s' but got '%s'", test.expected, h)
+				}
+			}
+		}(test))
+	}
+}
+
+func TestCheckHostname(t *testing.T) {
+	cfg := &config{
+		Services: []serviceConfig{
+			{UID: "1", ServiceNamespace: "default", ServiceName: "web", Hostname: "web.default.lb.example.com"},
+		},
+	}
+
+	if err := checkHostname(cfg, serviceConfig{UID: "1", Hostname: "web.default.lb.example.com"}); err != nil {
+		t.Errorf("unexpected error for own hostname: %s", err.Error())
+	}
+	if err := checkHostname(cfg, serviceConfig{UID: "2", Hostname: "web.default.lb.example.com"}); err == nil {
+		t.Errorf("expected error for hostname used by another service")
+	}
+	if err := checkHostname(cfg, serviceConfig{UID: "2"}); err != nil {
+		t.Errorf("unexpected error without hostname: %s", err.Error())
+	}
+}
+
+func TestLoadBalancerStatus(t *testing.T) {
+	status := loadBalancerStatus(serviceConfig{IP: "10.0.0.1", Hostname: "web.default.lb.example.com"})
+	expected := &v1.LoadBalancerStatus{
+		Ingress: []v1.LoadBalancerIngress{{IP: "10.0.0.1", Hostname: "web.default.lb.example.com"}},
+	}
+
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("expected status '%+v' but got '%+v'", expected, status)
+	}
+}
@@ -0,0 +1,87 @@
+package keepalivedcp
+
+import (
+	"errors"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/kubernetes/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+// instances implements cloudprovider.Instances using an inventory of
+// bare-metal machines.
+type instances struct {
+	inventory inventory
+}
+
+var _ cloudprovider.Instances = &instances{}
+
+// machine returns the machine for name, treating decommissioned machines as
+// not found.
+func (i *instances) machine(name types.NodeName) (*machine, error) {
+	m, err := i.inventory.machine(string(name))
+	if err != nil {
+		return nil, err
+	}
+	if m.Decommissioned {
+		return nil, cloudprovider.InstanceNotFound
+	}
+	return m, nil
+}
+
+// NodeAddresses returns the addresses of the specified instance.
+func (i *instances) NodeAddresses(name types.NodeName) ([]v1.NodeAddress, error) {
+	m, err := i.machine(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty list would make the node controller clear the node's
+	// addresses, so leave them as they are
+	if len(m.Addresses) == 0 {
+		return nil, fmt.Errorf("inventory has no addresses for machine '%s'", m.Name)
+	}
+
+	addrs := make([]v1.NodeAddress, 0, len(m.Addresses))
+	for _, a := range m.Addresses {
+		addrs = append(addrs, v1.NodeAddress{Type: a.Type, Address: a.Address})
+	}
+	return addrs, nil
+}
+
+// ExternalID returns the cloud provider ID of the node with the specified NodeName.
+func (i *instances) ExternalID(name types.NodeName) (string, error) {
+	return i.InstanceID(name)
+}
+
+// InstanceID returns the cloud provider ID of the node with the specified NodeName.
+func (i *instances) InstanceID(name types.NodeName) (string, error) {
+	m, err := i.machine(name)
+	if err != nil {
+		return "", err
+	}
+	if m.ID == "" {
+		return m.Name, nil
+	}
+	return m.ID, nil
+}
+
+// InstanceType returns the type of the specified instance.
+func (i *instances) InstanceType(name types.NodeName) (string, error) {
+	m, err := i.machine(name)
+	if err != nil {
+		return "", err
+	}
+	return m.Type, nil
+}
+
+// AddSSHKeyToAllInstances is not supported for bare-metal machines.
+func (i *instances) AddSSHKeyToAllInstances(user string, keyData []byte) error {
+	return errors.New("unimplemented")
+}
+
+// CurrentNodeName returns the name of the node we are currently running on.
+func (i *instances) CurrentNodeName(hostname string) (types.NodeName, error) {
+	return types.NodeName(hostname), nil
+}
@@ -0,0 +1,99 @@
+package keepalivedcp
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/kubernetes/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+const testInventory = `
+- name: node-1
+  id: rack1-u12
+  type: r630
+  addresses:
+  - type: InternalIP
+    address: 10.0.0.1
+  - type: Hostname
+    address: node-1
+- name: node-2
+- name: node-3
+  decommissioned: true
+`
+
+func TestFileInventoryInstances(t *testing.T) {
+	f, err := ioutil.TempFile("", "inventory")
+	if err != nil {
+		t.Fatalf("error creating inventory file: %s", err.Error())
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(testInventory); err != nil {
+		t.Fatalf("error writing inventory file: %s", err.Error())
+	}
+	f.Close()
+
+	i := &instances{fileInventory(f.Name())}
+
+	addrs, err := i.NodeAddresses("node-1")
+	if err != nil {
+		t.Fatalf("got error: %s", err.Error())
+	}
+	expectedAddrs := []v1.NodeAddress{
+		{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+		{Type: v1.NodeHostName, Address: "node-1"},
+	}
+	if !reflect.DeepEqual(addrs, expectedAddrs) {
+		t.Errorf("expected addresses %v but got %v", expectedAddrs, addrs)
+	}
+
+	if _, err := i.NodeAddresses("node-2"); err == nil {
+		t.Errorf("expected error for machine without addresses but got none")
+	}
+
+	type testDef struct {
+		name         string
+		node         types.NodeName
+		expectedID   string
+		expectedType string
+		err          error
+	}
+
+	tests := []testDef{
+		{name: "machine with id", node: "node-1", expectedID: "rack1-u12", expectedType: "r630"},
+		{name: "machine without id", node: "node-2", expectedID: "node-2"},
+		{name: "decommissioned machine", node: "node-3", err: cloudprovider.InstanceNotFound},
+		{name: "unknown machine", node: "node-4", err: cloudprovider.InstanceNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				id, err := i.ExternalID(test.node)
+				if err != test.err {
+					t.Errorf("expected error '%v' but got '%v'", test.err, err)
+					return
+				}
+				if id != test.expectedID {
+					t.Errorf("expected id '%s' but got '%s'", test.expectedID, id)
+				}
+
+				if test.err != nil {
+					return
+				}
+
+				it, err := i.InstanceType(test.node)
+				if err != nil {
+					t.Errorf("got error: %s", err.Error())
+					return
+				}
+				if it != test.expectedType {
+					t.Errorf("expected type '%s' but got '%s'", test.expectedType, it)
+				}
+			}
+		}(test))
+	}
+}
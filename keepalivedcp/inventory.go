@@ -0,0 +1,149 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+const (
+	nodeInstanceIDAnnotationKey     = "k8s.co/keepalived-instance-id"
+	nodeInstanceTypeAnnotationKey   = "k8s.co/keepalived-instance-type"
+	nodeAddressesAnnotationKey      = "k8s.co/keepalived-addresses"
+	nodeDecommissionedAnnotationKey = "k8s.co/keepalived-decommissioned"
+)
+
+// machine is an entry in the inventory of bare-metal machines.
+type machine struct {
+	Name string `json:"name"`
+	// ID is the instance ID of the machine, which defaults to its name
+	ID        string           `json:"id,omitempty"`
+	Type      string           `json:"type,omitempty"`
+	Addresses []machineAddress `json:"addresses,omitempty"`
+	// Decommissioned machines are treated as if they do not exist
+	Decommissioned bool `json:"decommissioned,omitempty"`
+}
+
+type machineAddress struct {
+	Type    v1.NodeAddressType `json:"type"`
+	Address string             `json:"address"`
+}
+
+// inventory is a source of information about machines.
+type inventory interface {
+	// machine returns the machine with the given node name, or
+	// cloudprovider.InstanceNotFound if it is not in the inventory.
+	machine(name string) (*machine, error)
+}
+
+// newInventory returns the inventory described by source, which is one of:
+//
+//	file:<path>                 a YAML or JSON file containing a list of machines
+//	configmap:<namespace>/<name> a ConfigMap with one YAML or JSON machine per node name
+//	annotations                 annotations on the Node objects themselves
+func newInventory(kubeClient kubernetes.Interface, source string) (inventory, error) {
+	switch {
+	case strings.HasPrefix(source, "file:"):
+		return fileInventory(strings.TrimPrefix(source, "file:")), nil
+	case strings.HasPrefix(source, "configmap:"):
+		parts := strings.Split(strings.TrimPrefix(source, "configmap:"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid inventory source '%s': expected configmap:<namespace>/<name>", source)
+		}
+		return &configMapInventory{kubeClient, parts[0], parts[1]}, nil
+	case source == "annotations":
+		return &annotationInventory{kubeClient}, nil
+	}
+	return nil, fmt.Errorf("invalid inventory source '%s': must be one of file:<path>, configmap:<namespace>/<name> or annotations", source)
+}
+
+// fileInventory reads machines from a file, which is re-read on each lookup
+// so that changes are picked up without restarting.
+type fileInventory string
+
+func (f fileInventory) machine(name string) (*machine, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return nil, fmt.Errorf("error reading inventory file: %s", err.Error())
+	}
+
+	var machines []machine
+	if err := yaml.Unmarshal(data, &machines); err != nil {
+		return nil, fmt.Errorf("error parsing inventory file: %s", err.Error())
+	}
+
+	for i := range machines {
+		if machines[i].Name == name {
+			return &machines[i], nil
+		}
+	}
+
+	return nil, cloudprovider.InstanceNotFound
+}
+
+type configMapInventory struct {
+	kubeClient      kubernetes.Interface
+	namespace, name string
+}
+
+func (c *configMapInventory) machine(name string) (*machine, error) {
+	cm, err := c.kubeClient.CoreV1().ConfigMaps(c.namespace).Get(c.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting inventory configmap: %s", err.Error())
+	}
+
+	data, ok := cm.Data[name]
+	if !ok {
+		return nil, cloudprovider.InstanceNotFound
+	}
+
+	m := machine{Name: name}
+	if err := yaml.Unmarshal([]byte(data), &m); err != nil {
+		return nil, fmt.Errorf("error parsing inventory entry for '%s': %s", name, err.Error())
+	}
+
+	return &m, nil
+}
+
+type annotationInventory struct {
+	kubeClient kubernetes.Interface
+}
+
+func (a *annotationInventory) machine(name string) (*machine, error) {
+	node, err := a.kubeClient.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, cloudprovider.InstanceNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting node: %s", err.Error())
+	}
+
+	m := machine{
+		Name:           name,
+		ID:             node.Annotations[nodeInstanceIDAnnotationKey],
+		Type:           node.Annotations[nodeInstanceTypeAnnotationKey],
+		Decommissioned: node.Annotations[nodeDecommissionedAnnotationKey] == "true",
+	}
+
+	// addresses are given as a comma separated list of type=address pairs,
+	// eg. InternalIP=10.0.0.1,Hostname=node-1
+	if addrs := node.Annotations[nodeAddressesAnnotationKey]; addrs != "" {
+		for _, a := range strings.Split(addrs, ",") {
+			parts := strings.SplitN(strings.TrimSpace(a), "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid address '%s' in annotation %s", a, nodeAddressesAnnotationKey)
+			}
+			m.Addresses = append(m.Addresses, machineAddress{Type: v1.NodeAddressType(parts[0]), Address: parts[1]})
+		}
+	}
+
+	return &m, nil
+}
@@ -0,0 +1,99 @@
+package keepalivedcp
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	// configFormatVIP writes one 'ip: namespace/name[:method]' entry per
+	// service for kube-keepalived-vip to consume
+	configFormatVIP = "kube-keepalived-vip"
+	// configFormatKeepalived writes the virtual_server section of a native
+	// keepalived.conf under keepalivedConfKey
+	configFormatKeepalived = "keepalived"
+
+	keepalivedConfKey = "keepalived.conf"
+
+	defaultScheduler     = "rr"
+	defaultForwardMethod = "NAT"
+)
+
+// toKeepalivedConf renders the virtual_server blocks of a keepalived.conf for
+// every service in the config, using the config's nodes as real servers. One
+// virtual_server is emitted per service port and protocol, forwarding to the
+// port's NodePort. The output is intended to be included from a
+// keepalived.conf that defines the vrrp_instance holding the VIPs. Services
+// using the PROXY protocol are forwarded by haproxy instead, see
+// keepalivedRenderer.
+func (c *config) toKeepalivedConf() string {
+	var b bytes.Buffer
+	for _, s := range c.Services {
+		if s.ProxyProtocol != "" {
+			continue
+		}
+		for _, p := range s.Ports {
+			s.writeVirtualServer(&b, p, c.Nodes)
+		}
+	}
+	return b.String()
+}
+
+func (s serviceConfig) writeVirtualServer(b *bytes.Buffer, p servicePort, nodes []string) {
+	scheduler := s.Scheduler
+	if scheduler == "" {
+		scheduler = defaultScheduler
+	}
+	forwardMethod := s.ForwardMethod
+	if forwardMethod == "" {
+		forwardMethod = defaultForwardMethod
+	}
+	hc := defaultHealthCheck
+	if s.HealthCheck != nil {
+		hc = *s.HealthCheck
+	}
+
+	fmt.Fprintf(b, "# %s/%s %d/%s\n", s.ServiceNamespace, s.ServiceName, p.Port, p.Protocol)
+	fmt.Fprintf(b, "virtual_server %s %d {\n", s.IP, p.Port)
+	if hc.appliesTo(p.Protocol) {
+		fmt.Fprintf(b, "    delay_loop %d\n", hc.interval())
+	}
+	fmt.Fprintf(b, "    lb_algo %s\n", scheduler)
+	fmt.Fprintf(b, "    lb_kind %s\n", forwardMethod)
+	if s.PersistenceTimeout != 0 {
+		fmt.Fprintf(b, "    persistence_timeout %d\n", s.PersistenceTimeout)
+	}
+	if s.PersistenceGranularity != "" {
+		fmt.Fprintf(b, "    persistence_granularity %s\n", s.PersistenceGranularity)
+	}
+	fmt.Fprintf(b, "    protocol %s\n", p.Protocol)
+	for _, n := range nodes {
+		fmt.Fprintf(b, "    real_server %s %d {\n", n, p.NodePort)
+		fmt.Fprintf(b, "        weight 1\n")
+		if hc.appliesTo(p.Protocol) {
+			writeHealthCheck(b, hc, p.NodePort)
+		}
+		fmt.Fprintf(b, "    }\n")
+	}
+	fmt.Fprintf(b, "}\n\n")
+}
+
+func writeHealthCheck(b *bytes.Buffer, hc healthCheck, port int32) {
+	fmt.Fprintf(b, "        %s {\n", hc.Type)
+	switch hc.Type {
+	case healthCheckHTTP, healthCheckSSL:
+		fmt.Fprintf(b, "            url {\n")
+		fmt.Fprintf(b, "                path %s\n", hc.path())
+		fmt.Fprintf(b, "                status_code %d\n", hc.status())
+		fmt.Fprintf(b, "            }\n")
+	case healthCheckMisc:
+		fmt.Fprintf(b, "            misc_path \"%s\"\n", hc.Path)
+		fmt.Fprintf(b, "            misc_timeout %d\n", defaultHealthCheckTimeout)
+	}
+	if hc.Type != healthCheckMisc {
+		fmt.Fprintf(b, "            connect_port %d\n", port)
+		fmt.Fprintf(b, "            connect_timeout %d\n", defaultHealthCheckTimeout)
+	}
+	fmt.Fprintf(b, "            retry %d\n", hc.retries())
+	fmt.Fprintf(b, "        }\n")
+}
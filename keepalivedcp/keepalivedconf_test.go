@@ -0,0 +1,58 @@
+package keepalivedcp
+
+import "testing"
+
+func TestToKeepalivedConf(t *testing.T) {
+	cfg := config{
+		Services: []serviceConfig{
+			{
+				UID:                "a",
+				IP:                 "10.0.0.1",
+				ServiceNamespace:   "kube-system",
+				ServiceName:        "dns",
+				ForwardMethod:      "DR",
+				Scheduler:          "sh",
+				PersistenceTimeout: 300,
+				Ports: []servicePort{
+					{Protocol: "UDP", Port: 53, NodePort: 30053},
+					{Protocol: "TCP", Port: 53, NodePort: 30054},
+				},
+			},
+		},
+		Nodes: []string{"192.168.0.1"},
+	}
+
+	expected := `# kube-system/dns 53/UDP
+virtual_server 10.0.0.1 53 {
+    lb_algo sh
+    lb_kind DR
+    persistence_timeout 300
+    protocol UDP
+    real_server 192.168.0.1 30053 {
+        weight 1
+    }
+}
+
+# kube-system/dns 53/TCP
+virtual_server 10.0.0.1 53 {
+    delay_loop 5
+    lb_algo sh
+    lb_kind DR
+    persistence_timeout 300
+    protocol TCP
+    real_server 192.168.0.1 30054 {
+        weight 1
+        TCP_CHECK {
+            connect_port 30054
+            connect_timeout 3
+            retry 3
+        }
+    }
+}
+
+`
+
+	if out := cfg.toKeepalivedConf(); out != expected {
+		t.Errorf("expected keepalived.conf:\n%s\nbut got:\n%s", expected, out)
+	}
+}
@@ -3,12 +3,20 @@ package keepalivedcp
 import (
 	"fmt"
 	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/golang/glog"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/api/v1"
 	"k8s.io/kubernetes/pkg/cloudprovider"
 )
@@ -17,16 +25,66 @@ const configMapAnnotationKey = "k8s.co/cloud-provider-config"
 const serviceForwardMethodAnnotationKey = "k8s.co/keepalived-forward-method"
 
 type KeepalivedLoadBalancer struct {
-	kubeClient      *kubernetes.Clientset
+	kubeClient      kubernetes.Interface
+	recorder        record.EventRecorder
 	namespace, name string
-	serviceCidr     string
 	forwardMethod   string
+	configFormat    string
+
+	// pools are the IP pools VIPs are allocated from
+	pools []pool
+	// topology is used to determine which zone nodes are in, and may be nil
+	topology topology
+	// hostnameTemplate generates the hostname of services without a
+	// hostname annotation, and may be nil
+	hostnameTemplate *template.Template
+	// restrictHostnames limits hostname annotations to the domain of their
+	// namespace, as hostnames are published to DNS
+	restrictHostnames bool
+	// healthCheckScripts are the scripts services may run as MISC_CHECK
+	// health checks
+	healthCheckScripts []string
+	// quotas limit the number of VIPs allocated in each namespace
+	quotas []quota
+	// firewall renders the source ranges of services into firewall rules,
+	// and may be nil
+	firewall *firewall
+	// feed publishes the allocations after every change, and may be nil
+	feed *allocationFeed
+	// notifier sends notifications of allocation changes, and may be nil
+	notifier *notifier
+	// publishMu serializes writing the ConfigMap with refreshing the
+	// published allocations from it, so that the allocations of an older
+	// ConfigMap are never published after those of a newer one
+	publishMu sync.Mutex
+	// recoverFromStatus causes a config annotation that cannot be decoded to
+	// be recovered from service status when a service is synced
+	recoverFromStatus bool
+
+	// dryRun causes changes to the ConfigMap to be logged to dryRunLog
+	// instead of being made
+	dryRun    bool
+	dryRunLog *dryRunLog
 }
 
 var _ cloudprovider.LoadBalancer = &KeepalivedLoadBalancer{}
 
-func NewKeepalivedLoadBalancer(kubeClient *kubernetes.Clientset, ns, name, serviceCidr string, forwardMethod string) cloudprovider.LoadBalancer {
-	return &KeepalivedLoadBalancer{kubeClient, ns, name, serviceCidr, forwardMethod}
+func NewKeepalivedLoadBalancer(kubeClient kubernetes.Interface, recorder record.EventRecorder, ns, name, serviceCidr string, forwardMethod, configFormat string) *KeepalivedLoadBalancer {
+	if configFormat == "" {
+		configFormat = configFormatVIP
+	}
+	k := &KeepalivedLoadBalancer{
+		kubeClient:    kubeClient,
+		recorder:      recorder,
+		namespace:     ns,
+		name:          name,
+		forwardMethod: forwardMethod,
+		configFormat:  configFormat,
+	}
+	if serviceCidr != "" {
+		k.pools = []pool{{Name: defaultPoolName, CIDR: serviceCidr}}
+	}
+	return k
 }
 
 func (k *KeepalivedLoadBalancer) GetLoadBalancer(clusterName string, service *v1.Service) (status *v1.LoadBalancerStatus, exists bool, err error) {
@@ -44,9 +102,7 @@ func (k *KeepalivedLoadBalancer) GetLoadBalancer(clusterName string, service *v1
 
 	for _, svc := range cfg.Services {
 		if svc.UID == string(service.UID) {
-			return &v1.LoadBalancerStatus{
-				Ingress: []v1.LoadBalancerIngress{{IP: svc.IP}},
-			}, true, nil
+			return loadBalancerStatus(svc), true, nil
 		}
 	}
 
@@ -54,11 +110,11 @@ func (k *KeepalivedLoadBalancer) GetLoadBalancer(clusterName string, service *v1
 }
 
 func (k *KeepalivedLoadBalancer) EnsureLoadBalancer(clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
-	return k.syncLoadBalancer(service)
+	return k.syncLoadBalancer(service, nodes)
 }
 
 func (k *KeepalivedLoadBalancer) UpdateLoadBalancer(clusterName string, service *v1.Service, nodes []*v1.Node) error {
-	_, err := k.syncLoadBalancer(service)
+	_, err := k.syncLoadBalancer(service, nodes)
 	return err
 }
 
@@ -69,13 +125,7 @@ func (k *KeepalivedLoadBalancer) EnsureLoadBalancerDeleted(clusterName string, s
 func (k *KeepalivedLoadBalancer) deleteLoadBalancer(service *v1.Service) error {
 	glog.Infof("ensure service '%s' (%s) is deleted", service.Name, service.UID)
 
-	cm, err := k.getConfigMap()
-
-	if err != nil {
-		return err
-	}
-
-	cfg, err := configFrom(cm)
+	cm, cfg, err := k.loadConfig(service)
 
 	if err != nil {
 		return err
@@ -85,20 +135,12 @@ func (k *KeepalivedLoadBalancer) deleteLoadBalancer(service *v1.Service) error {
 		// service already exists in the config so just return the status
 		if svc.UID == string(service.UID) {
 			glog.Infof("found service '%s' (%s) for deletion (%s)", service.Name, service.UID, svc.IP)
-			cfg.deleteService(svc)
-			delete(cm.Data, svc.IP)
-
-			cfgBytes, err := cfg.encode()
-
-			if err != nil {
-				return fmt.Errorf("error encoding updated config: %s", err.Error())
+			if err := k.releaseService(cm, cfg, svc); err != nil {
+				return err
 			}
 
-			cm.Annotations[configMapAnnotationKey] = string(cfgBytes)
-
-			glog.Infof("update configmap config annotation: %s", string(cfgBytes))
-			if _, err = k.kubeClient.ConfigMaps(k.namespace).Update(cm); err != nil {
-				return fmt.Errorf("error updating keepalived config: %s", err.Error())
+			if err := k.updateConfigMap(cm, cfg); err != nil {
+				return err
 			}
 
 			glog.Infof("updated configmap")
@@ -109,22 +151,41 @@ func (k *KeepalivedLoadBalancer) deleteLoadBalancer(service *v1.Service) error {
 	return nil
 }
 
-func (k *KeepalivedLoadBalancer) syncLoadBalancer(service *v1.Service) (*v1.LoadBalancerStatus, error) {
+func (k *KeepalivedLoadBalancer) syncLoadBalancer(service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
 	glog.Infof("syncing service '%s' (%s)", service.Name, service.UID)
 
-	cm, err := k.getConfigMap()
+	desired, err := k.serviceConfigFor(service)
 
 	if err != nil {
+		k.recordEventf(service, apiv1.EventTypeWarning, eventReasonInvalidConfig, "Error configuring load balancer: %s", err.Error())
 		return nil, err
 	}
 
-	cfg, err := configFrom(cm)
+	if unapplied := k.unappliedAnnotations(service); len(unapplied) > 0 {
+		glog.Warningf("annotations %s of service '%s/%s' are not applied by %s", strings.Join(unapplied, ", "), service.Namespace, service.Name, k.configFormat)
+		k.recordEventf(service, apiv1.EventTypeWarning, eventReasonSettingsNotApplied, "Annotations %s are not applied by %s, set KEEPALIVED_CONFIG_FORMAT to %s to apply them", strings.Join(unapplied, ", "), k.configFormat, configFormatKeepalived)
+	}
+
+	if err := k.checkPermitted(desired, service.Spec.LoadBalancerIP); err != nil {
+		k.recordEventf(service, apiv1.EventTypeWarning, eventReasonInvalidConfig, "Error configuring load balancer: %s", err.Error())
+		return nil, err
+	}
+
+	cm, cfg, err := k.loadConfig(service)
 
 	if err != nil {
 		return nil, err
 	}
 
-	forwardMethod := k.forwardMethod
+	observeUsage(cfg)
+
+	if err := checkHostname(cfg, desired); err != nil {
+		k.recordEventf(service, apiv1.EventTypeWarning, eventReasonInvalidConfig, "Error configuring load balancer: %s", err.Error())
+		return nil, err
+	}
+
+	nodeAddrs := nodeAddresses(nodes)
+	nodesChanged := !reflect.DeepEqual(cfg.Nodes, nodeAddrs)
 	reallocateIP := true
 	var svc serviceConfig
 	for _, svc = range cfg.Services {
@@ -137,69 +198,235 @@ func (k *KeepalivedLoadBalancer) syncLoadBalancer(service *v1.Service) (*v1.Load
 				break
 			}
 
-			if annotationForwardMethod, ok := service.Annotations[serviceForwardMethodAnnotationKey]; ok {
-				forwardMethod = annotationForwardMethod
+			// likewise if the service has been moved to another pool
+			if desired.Pool != "" && desired.Pool != svc.Pool {
+				break
 			}
-			if forwardMethod != svc.ForwardMethod {
+
+			// if any of the service's settings have changed, keep the
+			// IP address but continue to update
+			desired.IP = svc.IP
+			desired.Pool = svc.Pool
+			desired.Zone = svc.Zone
+			if !reflect.DeepEqual(desired, svc) || nodesChanged {
 				reallocateIP = false
 				break
 			}
 
-			return &v1.LoadBalancerStatus{
-				Ingress: []v1.LoadBalancerIngress{{IP: svc.IP}},
-			}, nil
+			return loadBalancerStatus(svc), nil
 		}
 	}
 
 	ip := svc.IP
 	if lbip := service.Spec.LoadBalancerIP; lbip != "" {
 		if i := net.ParseIP(lbip); i == nil {
-			return nil, fmt.Errorf("invalid loadBalancerIP specified '%s': %s", lbip, err.Error())
+			return nil, fmt.Errorf("invalid loadBalancerIP specified '%s'", lbip)
 		}
 		ip = lbip
+		desired.Pool, desired.Zone = "", ""
+		var pools []*pool
+		if p, ok := k.poolContaining(ip); ok {
+			desired.Pool, desired.Zone = p.Name, p.Zone
+			pools = []*pool{p}
+		}
+		if existing, ok := cfg.serviceByUID(desired.UID); !ok || existing.IP != ip {
+			if cfg.isReserved(ip) {
+				err := fmt.Errorf("loadBalancerIP %s is reserved", ip)
+				k.recordEventf(service, apiv1.EventTypeWarning, eventReasonInvalidConfig, "Error configuring load balancer: %s", err.Error())
+				return nil, err
+			}
+			if _, err := k.withinQuota(cfg, desired, pools); err != nil {
+				k.rejectOverQuota(service, err)
+				return nil, err
+			}
+		}
 	} else if reallocateIP {
-		ip, err = cfg.allocateIP(k.serviceCidr)
+		var p *pool
+		ip, p, err = k.allocateFromPools(cfg, desired, nodes)
 		if err != nil {
+			k.rejectOverQuota(service, err)
 			return nil, err
 		}
+		desired.Pool, desired.Zone = p.Name, p.Zone
+	}
+
+	desired.IP = ip
+	if err := k.checkSharing(cfg, desired); err != nil {
+		k.recordEventf(service, apiv1.EventTypeWarning, eventReasonInvalidConfig, "Error configuring load balancer: %s", err.Error())
+		return nil, err
+	}
+	k.reportUnenforcedRanges(service, desired)
+	existing, hadExisting := cfg.serviceByUID(desired.UID)
+	cfg.ensureService(desired)
+	cfg.Nodes = nodeAddrs
+	if cm.Data, err = k.configMapData(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := k.updateConfigMap(cm, cfg); err != nil {
+		return nil, err
+	}
+
+	// nothing was written in dry-run mode, so report the VIP the service
+	// already has rather than one that was never allocated
+	if k.dryRun {
+		if hadExisting && existing.IP == ip {
+			return loadBalancerStatus(existing), nil
+		}
+		return nil, fmt.Errorf("dry run: not allocating ip %s for service '%s' (%s)", ip, service.Name, service.UID)
+	}
+
+	glog.Infof("synced service '%s' (%s): %s", service.Name, service.UID, ip)
+
+	return loadBalancerStatus(desired), nil
+}
+
+// loadBalancerStatus returns the status of the load balancer of svc, with
+// its hostname if it has one.
+func loadBalancerStatus(svc serviceConfig) *v1.LoadBalancerStatus {
+	return &v1.LoadBalancerStatus{
+		Ingress: []v1.LoadBalancerIngress{{IP: svc.IP, Hostname: svc.Hostname}},
 	}
+}
 
-	sc := serviceConfig{
-		UID:              string(service.UID),
-		IP:               ip,
-		ServiceNamespace: service.Namespace,
-		ServiceName:      service.Name,
-		ForwardMethod:    forwardMethod,
+// releaseService removes svc from cfg, along with its entry in the ConfigMap
+// data.
+func (k *KeepalivedLoadBalancer) releaseService(cm *apiv1.ConfigMap, cfg *config, svc serviceConfig) error {
+	cfg.deleteService(svc)
+	if k.configFormat == configFormatVIP {
+		delete(cm.Data, svc.IP)
+		return nil
 	}
-	cfg.ensureService(sc)
+	data, err := k.configMapData(cfg)
+	if err != nil {
+		return err
+	}
+	cm.Data = data
+	return nil
+}
+
+// updateConfigMap stores cfg in the config annotation of cm, and writes cm
+// back to the API server.
+func (k *KeepalivedLoadBalancer) updateConfigMap(cm *apiv1.ConfigMap, cfg *config) error {
 	cfgBytes, err := cfg.encode()
 
 	if err != nil {
-		return nil, fmt.Errorf("error encoding updated config: %s", err.Error())
+		return fmt.Errorf("error encoding updated config: %s", err.Error())
 	}
 
-	cm.Data = cfg.toConfigMapData()
-	if forwardMethod != "" {
-		cm.Data[ip] = service.Namespace + "/" + service.Name + ":" + forwardMethod
-	} else {
-		cm.Data[ip] = service.Namespace + "/" + service.Name
+	if k.dryRun {
+		live, err := k.getConfigMap()
+		if err != nil {
+			return err
+		}
+		k.recordDryRun(live.Annotations[configMapAnnotationKey], live.Data, string(cfgBytes), cm.Data)
+		k.syncFirewall(cm, cfg)
+		return nil
+	}
+
+	if err := k.writeConfigMap(cm, cfg, cfgBytes); err != nil {
+		return err
 	}
+
+	observeUsage(cfg)
+
+	k.syncFirewall(cm, cfg)
+	return nil
+}
+
+// writeConfigMap writes cm with the encoded cfg to the API server, and
+// publishes cfg to the feed and notifier.
+func (k *KeepalivedLoadBalancer) writeConfigMap(cm *apiv1.ConfigMap, cfg *config, cfgBytes []byte) error {
+	k.publishMu.Lock()
+	defer k.publishMu.Unlock()
+
 	cm.Annotations[configMapAnnotationKey] = string(cfgBytes)
 
 	glog.Infof("update configmap config annotation: %s", string(cfgBytes))
-	if _, err = k.kubeClient.ConfigMaps(k.namespace).Update(cm); err != nil {
-		return nil, fmt.Errorf("error updating keepalived config: %s", err.Error())
+	if _, err := k.kubeClient.CoreV1().ConfigMaps(k.namespace).Update(cm); err != nil {
+		return fmt.Errorf("error updating keepalived config: %s", err.Error())
 	}
 
-	glog.Infof("synced service '%s' (%s): %s", service.Name, service.UID, ip)
+	k.publish(cfg)
+	return nil
+}
 
-	return &v1.LoadBalancerStatus{
-		Ingress: []v1.LoadBalancerIngress{{IP: ip}},
-	}, nil
+// publish sends the allocations in cfg to the feed and notifier, which only
+// pass on what changed since they were last published.
+func (k *KeepalivedLoadBalancer) publish(cfg *config) {
+	if k.feed != nil {
+		k.feed.publish(cfg)
+	}
+	if k.notifier != nil {
+		k.notifier.publish(cfg)
+	}
+}
+
+// refreshPublished publishes the allocations read from the ConfigMap, so that
+// changes made by others, eg. with ctl, are published too.
+func (k *KeepalivedLoadBalancer) refreshPublished() (*config, error) {
+	k.publishMu.Lock()
+	defer k.publishMu.Unlock()
+
+	cm, err := k.getConfigMap()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := configFrom(cm)
+	if err != nil {
+		return nil, err
+	}
+	k.publish(cfg)
+	return cfg, nil
+}
+
+// runRefresh refreshes the published allocations every interval until stopCh
+// is closed.
+func (k *KeepalivedLoadBalancer) runRefresh(interval time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if _, err := k.refreshPublished(); err != nil {
+			glog.Errorf("error refreshing published allocations: %s", err.Error())
+		}
+	}, interval, stopCh)
+}
+
+// configMapData renders cfg into the ConfigMap data format selected by the
+// provider's config format.
+func (k *KeepalivedLoadBalancer) configMapData(cfg *config) (map[string]string, error) {
+	r, ok := renderers[k.configFormat]
+	if !ok {
+		r = vipRenderer{}
+	}
+	data, err := r.render(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error rendering %s config: %s", k.configFormat, err.Error())
+	}
+	return data, nil
+}
+
+// nodeAddresses returns a sorted list of the internal address of each node,
+// falling back to the first address reported if it has no internal address.
+func nodeAddresses(nodes []*v1.Node) []string {
+	var addrs []string
+	for _, n := range nodes {
+		if len(n.Status.Addresses) == 0 {
+			continue
+		}
+		addr := n.Status.Addresses[0].Address
+		for _, a := range n.Status.Addresses {
+			if a.Type == v1.NodeInternalIP {
+				addr = a.Address
+				break
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
 }
 
 func (k *KeepalivedLoadBalancer) getConfigMap() (*apiv1.ConfigMap, error) {
-	cm, err := k.kubeClient.ConfigMaps(k.namespace).Get(k.name, metav1.GetOptions{})
+	cm, err := k.kubeClient.CoreV1().ConfigMaps(k.namespace).Get(k.name, metav1.GetOptions{})
 
 	if err != nil {
 		return nil, fmt.Errorf("error getting keepalived configmap: %s", err.Error())
@@ -0,0 +1,57 @@
+package keepalivedcp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The metrics are registered with the default registry, which is served by
+// the cloud controller manager at /metrics.
+var (
+	vipsMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "keepalived_cloud_provider",
+		Name:      "vips",
+		Help:      "Number of VIPs allocated to the services in each namespace, by pool.",
+	}, []string{"namespace", "pool"})
+	vipQuotaMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "keepalived_cloud_provider",
+		Name:      "vip_quota",
+		Help:      "Maximum number of VIPs that can be allocated in each namespace, in total if pool is empty, or from a pool.",
+	}, []string{"namespace", "pool"})
+	quotaRejectionsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "keepalived_cloud_provider",
+		Name:      "quota_rejections_total",
+		Help:      "Number of times a VIP was not allocated because a namespace's quota was exceeded.",
+	}, []string{"namespace"})
+)
+
+func init() {
+	prometheus.MustRegister(vipsMetric)
+	prometheus.MustRegister(vipQuotaMetric)
+	prometheus.MustRegister(quotaRejectionsMetric)
+}
+
+// observeUsage sets the VIP usage metrics from cfg.
+func observeUsage(cfg *config) {
+	usage := map[[2]string]int{}
+	for _, s := range cfg.Services {
+		usage[[2]string{s.ServiceNamespace, s.Pool}]++
+	}
+
+	vipsMetric.Reset()
+	for l, n := range usage {
+		vipsMetric.WithLabelValues(l[0], l[1]).Set(float64(n))
+	}
+}
+
+// observeQuotas sets the quota metrics from quotas.
+func observeQuotas(quotas []quota) {
+	vipQuotaMetric.Reset()
+	for _, q := range quotas {
+		if q.VIPs != nil {
+			vipQuotaMetric.WithLabelValues(q.Namespace, "").Set(float64(*q.VIPs))
+		}
+		for p, limit := range q.Pools {
+			vipQuotaMetric.WithLabelValues(q.Namespace, p).Set(float64(limit))
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package keepalivedcp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	notificationAllocate   = "allocate"
+	notificationReallocate = "reallocate"
+	notificationRelease    = "release"
+	// notificationRename is sent when only the hostname of a service has
+	// changed. It is internal, and only delivered to queues that subscribe
+	// to all events, such as the DNS queue, and never to endpoints.
+	notificationRename = "rename"
+)
+
+// endpointEvents are the events endpoints can subscribe to, and are sent if
+// they do not list any.
+var endpointEvents = []string{notificationAllocate, notificationReallocate, notificationRelease}
+
+const (
+	// notificationSignatureHeader holds the hex encoded HMAC-SHA256 of the
+	// request body, keyed with the endpoint's secret
+	notificationSignatureHeader = "X-Keepalived-Signature"
+	notificationEventHeader     = "X-Keepalived-Event"
+
+	defaultNotificationAttempts = 5
+	defaultNotificationTimeout  = 10 * time.Second
+	notificationQueueLength     = 1000
+	notificationInitialBackoff  = time.Second
+	notificationMaxBackoff      = 5 * time.Minute
+)
+
+// notificationEndpoint is an HTTP endpoint that is sent a notification when
+// a VIP is allocated, reallocated or released.
+type notificationEndpoint struct {
+	URL string `json:"url"`
+	// Secret is the key the payload is signed with, so that the endpoint
+	// can reject notifications that were not sent by the provider
+	Secret string `json:"secret"`
+	// Events are the events to notify the endpoint of, or allocate,
+	// reallocate and release if empty
+	Events []string `json:"events,omitempty"`
+	// Attempts is the number of times a notification is attempted before it
+	// is dropped
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// validateNotificationEndpoints checks that endpoints have URLs and secrets,
+// and only subscribe to known events.
+func validateNotificationEndpoints(endpoints []notificationEndpoint) error {
+	for i, e := range endpoints {
+		if e.URL == "" {
+			return fmt.Errorf("notification endpoint %d has no url", i)
+		}
+		if e.Secret == "" {
+			return fmt.Errorf("notification endpoint '%s' has no secret", e.URL)
+		}
+		for _, ev := range e.Events {
+			switch ev {
+			case notificationAllocate, notificationReallocate, notificationRelease:
+			default:
+				return fmt.Errorf("invalid event '%s' for notification endpoint '%s': must be one of %s, %s, %s", ev, e.URL, notificationAllocate, notificationReallocate, notificationRelease)
+			}
+		}
+		if e.Attempts < 0 {
+			return fmt.Errorf("invalid attempts %d for notification endpoint '%s'", e.Attempts, e.URL)
+		}
+	}
+	return nil
+}
+
+// notification is the JSON payload sent to endpoints.
+type notification struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	UID       string    `json:"uid"`
+	IP        string    `json:"ip"`
+	Pool      string    `json:"pool,omitempty"`
+	Hostname  string    `json:"hostname,omitempty"`
+	// PreviousIP, PreviousPool and PreviousHostname are set for
+	// reallocations and renames
+	PreviousIP       string `json:"previousIP,omitempty"`
+	PreviousPool     string `json:"previousPool,omitempty"`
+	PreviousHostname string `json:"previousHostname,omitempty"`
+}
+
+// allocationChanges returns a notification for every service that was
+// allocated, reallocated or released between old and new. A service whose
+// hostname changed but whose IP did not is renamed.
+func allocationChanges(old, new *config, now time.Time) []notification {
+	var changes []notification
+	for _, s := range new.Services {
+		n := notification{Time: now, Namespace: s.ServiceNamespace, Name: s.ServiceName, UID: s.UID, IP: s.IP, Pool: s.Pool, Hostname: s.Hostname}
+		prev, ok := old.serviceByUID(s.UID)
+		switch {
+		case !ok:
+			n.Event = notificationAllocate
+		case prev.IP != s.IP:
+			n.Event = notificationReallocate
+			n.PreviousIP, n.PreviousPool, n.PreviousHostname = prev.IP, prev.Pool, prev.Hostname
+		case prev.Hostname != s.Hostname:
+			n.Event = notificationRename
+			n.PreviousIP, n.PreviousPool, n.PreviousHostname = prev.IP, prev.Pool, prev.Hostname
+		default:
+			continue
+		}
+		changes = append(changes, n)
+	}
+	for _, s := range old.Services {
+		if _, ok := new.serviceByUID(s.UID); !ok {
+			changes = append(changes, notification{Event: notificationRelease, Time: now, Namespace: s.ServiceNamespace, Name: s.ServiceName, UID: s.UID, IP: s.IP, Pool: s.Pool, Hostname: s.Hostname})
+		}
+	}
+	return changes
+}
+
+// currentAllocations returns an allocate notification for every service in
+// cfg.
+func currentAllocations(cfg *config, now time.Time) []notification {
+	return allocationChanges(&config{}, cfg, now)
+}
+
+// notifier delivers notifications to endpoints asynchronously, retrying
+// failed deliveries with exponential backoff. Each endpoint has its own
+// queue, so notifications are delivered to it in order, and a slow endpoint
+// does not delay the others.
+type notifier struct {
+	queues []*notificationQueue
+
+	mu sync.Mutex
+	// last is the config last published, that changes are notified
+	// against, or nil if none has been published yet
+	last *config
+}
+
+// notificationQueue holds the notifications waiting to be delivered to one
+// endpoint.
+type notificationQueue struct {
+	// target describes the endpoint in logs
+	target string
+	// events are the events delivered to the endpoint, or all if empty
+	events   []string
+	attempts int
+	pending  chan notification
+	// backoff is the delay before the first retry, which doubles for each
+	// following retry
+	backoff time.Duration
+	send    func(notification) error
+}
+
+func newNotifier() *notifier {
+	return &notifier{}
+}
+
+// add starts delivering notifications to q.
+func (n *notifier) add(q *notificationQueue) {
+	n.queues = append(n.queues, q)
+	go q.run()
+}
+
+func newDeliveryQueue(target string, events []string, attempts int, backoff time.Duration, send func(notification) error) *notificationQueue {
+	if attempts == 0 {
+		attempts = defaultNotificationAttempts
+	}
+	return &notificationQueue{
+		target:   target,
+		events:   events,
+		attempts: attempts,
+		pending:  make(chan notification, notificationQueueLength),
+		backoff:  backoff,
+		send:     send,
+	}
+}
+
+// newNotificationQueue returns a queue that POSTs notifications to the HTTP
+// endpoint e.
+func newNotificationQueue(e notificationEndpoint, backoff time.Duration) *notificationQueue {
+	client := &http.Client{Timeout: defaultNotificationTimeout}
+	events := e.Events
+	if len(events) == 0 {
+		events = endpointEvents
+	}
+	return newDeliveryQueue(e.URL, events, e.Attempts, backoff, func(nt notification) error {
+		return postNotification(client, e, nt)
+	})
+}
+
+// publish notifies the changes between the config last published and cfg.
+// The first config published is the baseline, and is not notified.
+func (n *notifier) publish(cfg *config) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.last != nil {
+		n.notify(allocationChanges(n.last, cfg, time.Now()))
+	}
+	n.last = cfg
+}
+
+// notify queues notifications for delivery, without blocking. Notifications
+// are dropped if an endpoint's queue is full.
+func (n *notifier) notify(notifications []notification) {
+	for _, q := range n.queues {
+		for _, nt := range notifications {
+			q.enqueue(nt)
+		}
+	}
+}
+
+func (q *notificationQueue) enqueue(nt notification) {
+	if !q.subscribed(nt.Event) {
+		return
+	}
+	select {
+	case q.pending <- nt:
+	default:
+		glog.Errorf("dropping %s notification for %s/%s to %s: queue is full", nt.Event, nt.Namespace, nt.Name, q.target)
+	}
+}
+
+func (q *notificationQueue) subscribed(event string) bool {
+	if len(q.events) == 0 {
+		return true
+	}
+	for _, e := range q.events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *notificationQueue) run() {
+	for nt := range q.pending {
+		q.deliver(nt)
+	}
+}
+
+// deliver sends nt to the endpoint, retrying until it is accepted or the
+// endpoint's attempts are exhausted.
+func (q *notificationQueue) deliver(nt notification) {
+	backoff := q.backoff
+	for attempt := 1; ; attempt++ {
+		err := q.send(nt)
+		if err == nil {
+			glog.V(2).Infof("delivered %s notification for %s/%s to %s", nt.Event, nt.Namespace, nt.Name, q.target)
+			return
+		}
+		if attempt >= q.attempts {
+			glog.Errorf("dropping %s notification for %s/%s to %s after %d attempts: %s", nt.Event, nt.Namespace, nt.Name, q.target, attempt, err.Error())
+			return
+		}
+		glog.Warningf("error delivering %s notification for %s/%s to %s, retrying in %s: %s", nt.Event, nt.Namespace, nt.Name, q.target, backoff, err.Error())
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > notificationMaxBackoff {
+			backoff = notificationMaxBackoff
+		}
+	}
+}
+
+// postNotification POSTs nt to the HTTP endpoint e, signed with its secret.
+func postNotification(client *http.Client, e notificationEndpoint, nt notification) error {
+	body, err := json.Marshal(nt)
+	if err != nil {
+		return fmt.Errorf("error encoding notification: %s", err.Error())
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(notificationEventHeader, nt.Event)
+	req.Header.Set(notificationSignatureHeader, "sha256="+signNotification(e.Secret, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signNotification returns the hex encoded HMAC-SHA256 of body keyed with
+// secret.
+func signNotification(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
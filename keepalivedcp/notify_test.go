@@ -0,0 +1,219 @@
+package keepalivedcp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAllocationChanges(t *testing.T) {
+	type testDef struct {
+		name     string
+		old, new []serviceConfig
+		expected []notification
+	}
+
+	now := time.Now()
+	web := serviceConfig{UID: "a", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "web", Pool: "default"}
+	movedWeb := serviceConfig{UID: "a", IP: "10.1.0.1", ServiceNamespace: "default", ServiceName: "web", Pool: "rack-1"}
+	namedWeb := serviceConfig{UID: "a", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "web", Pool: "default", Hostname: "web.lb.example.com"}
+	api := serviceConfig{UID: "b", IP: "10.0.0.2", ServiceNamespace: "default", ServiceName: "api", Pool: "default"}
+
+	tests := []testDef{
+		{
+			name: "no changes",
+			old:  []serviceConfig{web},
+			new:  []serviceConfig{web},
+		},
+		{
+			name: "allocate",
+			old:  []serviceConfig{web},
+			new:  []serviceConfig{web, api},
+			expected: []notification{
+				{Event: notificationAllocate, Time: now, Namespace: "default", Name: "api", UID: "b", IP: "10.0.0.2", Pool: "default"},
+			},
+		},
+		{
+			name: "reallocate",
+			old:  []serviceConfig{web},
+			new:  []serviceConfig{movedWeb},
+			expected: []notification{
+				{Event: notificationReallocate, Time: now, Namespace: "default", Name: "web", UID: "a", IP: "10.1.0.1", Pool: "rack-1", PreviousIP: "10.0.0.1", PreviousPool: "default"},
+			},
+		},
+		{
+			name: "hostname changed",
+			old:  []serviceConfig{web},
+			new:  []serviceConfig{namedWeb},
+			expected: []notification{
+				{Event: notificationRename, Time: now, Namespace: "default", Name: "web", UID: "a", IP: "10.0.0.1", Pool: "default", Hostname: "web.lb.example.com", PreviousIP: "10.0.0.1", PreviousPool: "default"},
+			},
+		},
+		{
+			name: "release",
+			old:  []serviceConfig{web, api},
+			new:  []serviceConfig{api},
+			expected: []notification{
+				{Event: notificationRelease, Time: now, Namespace: "default", Name: "web", UID: "a", IP: "10.0.0.1", Pool: "default"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				changes := allocationChanges(&config{Services: test.old}, &config{Services: test.new}, now)
+
+				if !reflect.DeepEqual(changes, test.expected) {
+					t.Errorf("expected notifications '%+v' but got '%+v'", test.expected, changes)
+				}
+			}
+		}(test))
+	}
+}
+
+func TestNotificationDelivery(t *testing.T) {
+	var lock sync.Mutex
+	var attempts int
+	var received []notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		attempts++
+		// fail the first two attempts, to check they are retried
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("error reading notification: %s", err.Error())
+			return
+		}
+		if sig := r.Header.Get(notificationSignatureHeader); sig != "sha256="+signNotification("s3cret", body) {
+			t.Errorf("invalid signature '%s'", sig)
+		}
+		n := notification{}
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Errorf("error decoding notification: %s", err.Error())
+		}
+		if ev := r.Header.Get(notificationEventHeader); ev != n.Event {
+			t.Errorf("expected event header '%s' but got '%s'", n.Event, ev)
+		}
+		received = append(received, n)
+	}))
+	defer server.Close()
+
+	q := newNotificationQueue(notificationEndpoint{URL: server.URL, Secret: "s3cret", Events: []string{notificationAllocate}}, time.Millisecond)
+	n := &notifier{queues: []*notificationQueue{q}}
+	n.notify([]notification{
+		{Event: notificationRelease, Namespace: "default", Name: "api", UID: "b", IP: "10.0.0.2"},
+		{Event: notificationAllocate, Namespace: "default", Name: "web", UID: "a", IP: "10.0.0.1"},
+	})
+	close(q.pending)
+	q.run()
+
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts but got %d", attempts)
+	}
+	if len(received) != 1 || received[0].UID != "a" {
+		t.Errorf("expected only the allocate notification but got '%+v'", received)
+	}
+}
+
+func TestNotificationDeliveryGivesUp(t *testing.T) {
+	var lock sync.Mutex
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	q := newNotificationQueue(notificationEndpoint{URL: server.URL, Secret: "s3cret", Attempts: 3}, time.Millisecond)
+	q.deliver(notification{Event: notificationAllocate, UID: "a"})
+
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts but got %d", attempts)
+	}
+}
+
+func TestNotificationQueueEvents(t *testing.T) {
+	endpoint := newNotificationQueue(notificationEndpoint{URL: "https://example.com", Secret: "s3cret"}, time.Millisecond)
+	if endpoint.subscribed(notificationRename) {
+		t.Errorf("expected endpoint not to be sent %s notifications", notificationRename)
+	}
+	for _, event := range endpointEvents {
+		if !endpoint.subscribed(event) {
+			t.Errorf("expected endpoint to be sent %s notifications", event)
+		}
+	}
+
+	dns := newDNSQueue(newDNSPublisher(dnsConfig{Server: "127.0.0.1:53", Zone: "lb.example.com"}), time.Millisecond)
+	if !dns.subscribed(notificationRename) {
+		t.Errorf("expected dns queue to be sent %s notifications", notificationRename)
+	}
+}
+
+func TestValidateNotificationEndpoints(t *testing.T) {
+	if err := validateNotificationEndpoints([]notificationEndpoint{{URL: "https://example.com", Secret: "s3cret"}}); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if err := validateNotificationEndpoints([]notificationEndpoint{{URL: "https://example.com"}}); err == nil {
+		t.Errorf("expected error for endpoint without secret")
+	}
+	if err := validateNotificationEndpoints([]notificationEndpoint{{URL: "https://example.com", Secret: "s3cret", Events: []string{"bogus"}}}); err == nil {
+		t.Errorf("expected error for unknown event")
+	}
+}
+
+func TestNotifierPublish(t *testing.T) {
+	q := newDeliveryQueue("test", nil, 1, time.Millisecond, func(notification) error { return nil })
+	n := &notifier{queues: []*notificationQueue{q}}
+
+	events := func() []string {
+		var got []string
+		for {
+			select {
+			case nt := <-q.pending:
+				got = append(got, nt.Event+" "+nt.IP+" "+nt.PreviousIP)
+			default:
+				return got
+			}
+		}
+	}
+
+	web := serviceConfig{UID: "a", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "web"}
+	moved := web
+	moved.IP = "10.0.0.2"
+
+	n.publish(&config{Services: []serviceConfig{web}})
+	if got := events(); len(got) != 0 {
+		t.Errorf("expected no notifications for the baseline but got %v", got)
+	}
+
+	// a release made outside the provider, eg. with ctl, is notified when it
+	// is published, before the service is allocated a new ip
+	n.publish(&config{})
+	n.publish(&config{Services: []serviceConfig{moved}})
+	expected := []string{"release 10.0.0.1 ", "allocate 10.0.0.2 "}
+	if got := events(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected notifications %v but got %v", expected, got)
+	}
+
+	// if the release is not published in between, the service is reallocated
+	n.publish(&config{Services: []serviceConfig{web}})
+	expected = []string{"reallocate 10.0.0.1 10.0.0.2"}
+	if got := events(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected notifications %v but got %v", expected, got)
+	}
+}
@@ -0,0 +1,209 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"net"
+
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+const servicePoolAnnotationKey = "k8s.co/keepalived-pool"
+
+// defaultPoolName is the name of the pool created from
+// KEEPALIVED_SERVICE_CIDR when no pools are configured.
+const defaultPoolName = "default"
+
+// pool is a range of IPs that VIPs can be allocated from. A pool can be
+// restricted to the nodes in a zone, or matching a node selector, when VIPs
+// are only routable to some nodes.
+type pool struct {
+	Name string `json:"name"`
+	CIDR string `json:"cidr"`
+	// Zone is the failure domain, as reported by the topology, of the nodes
+	// that VIPs in this pool can be hosted on
+	Zone string `json:"zone,omitempty"`
+	// NodeSelector matches the labels of the nodes that VIPs in this pool
+	// can be hosted on
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Namespaces are the namespaces whose services can be allocated VIPs
+	// from this pool
+	Namespaces []string `json:"namespaces,omitempty"`
+	// NamespaceSelector matches the labels of the namespaces whose services
+	// can be allocated VIPs from this pool. If neither Namespaces nor
+	// NamespaceSelector are set, the pool can be used by all namespaces.
+	NamespaceSelector map[string]string `json:"namespaceSelector,omitempty"`
+}
+
+// validatePools checks that pools have unique names and valid, non-overlapping
+// CIDRs with at least one allocatable address.
+func validatePools(pools []pool) error {
+	names := map[string]bool{}
+	ipnets := make([]*net.IPNet, len(pools))
+	for i, p := range pools {
+		if p.Name == "" {
+			return fmt.Errorf("pool %d has no name", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate pool name '%s'", p.Name)
+		}
+		names[p.Name] = true
+
+		_, ipnet, err := net.ParseCIDR(p.CIDR)
+		if err != nil {
+			return fmt.Errorf("invalid cidr '%s' for pool '%s': %s", p.CIDR, p.Name, err.Error())
+		}
+		// the network and broadcast addresses are never allocated
+		if ones, bits := ipnet.Mask.Size(); bits-ones < 2 {
+			return fmt.Errorf("cidr '%s' for pool '%s' is too small: it has no allocatable addresses", p.CIDR, p.Name)
+		}
+		// an IP in more than one pool would be permitted or counted by
+		// whichever pool happens to be listed first
+		for j, other := range ipnets[:i] {
+			if other.Contains(ipnet.IP) || ipnet.Contains(other.IP) {
+				return fmt.Errorf("cidr '%s' for pool '%s' overlaps cidr '%s' for pool '%s'", p.CIDR, p.Name, pools[j].CIDR, pools[j].Name)
+			}
+		}
+		ipnets[i] = ipnet
+	}
+	return nil
+}
+
+// hosts returns true if VIPs in the pool can be hosted on node.
+func (p *pool) hosts(node *v1.Node, topo topology) bool {
+	if p.Zone != "" {
+		if topo == nil {
+			return false
+		}
+		zone, ok := topo.nodeZone(node)
+		if !ok || zone.FailureDomain != p.Zone {
+			return false
+		}
+	}
+	for k, v := range p.NodeSelector {
+		if node.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// contains returns true if ip is within the pool's CIDR.
+func (p *pool) contains(ip string) bool {
+	_, ipnet, err := net.ParseCIDR(p.CIDR)
+	if err != nil {
+		return false
+	}
+	i := net.ParseIP(ip)
+	return i != nil && ipnet.Contains(i)
+}
+
+func (k *KeepalivedLoadBalancer) poolByName(name string) (*pool, bool) {
+	for i := range k.pools {
+		if k.pools[i].Name == name {
+			return &k.pools[i], true
+		}
+	}
+	return nil, false
+}
+
+// poolContaining returns the pool that ip is within, if any.
+func (k *KeepalivedLoadBalancer) poolContaining(ip string) (*pool, bool) {
+	for i := range k.pools {
+		if k.pools[i].contains(ip) {
+			return &k.pools[i], true
+		}
+	}
+	return nil, false
+}
+
+// candidatePools returns the pools that a VIP for sc can be allocated from,
+// in order of preference. If sc names a pool, only that pool is returned.
+// Otherwise the pools that permit sc's namespace, and can be hosted on at
+// least one of nodes, are returned, in the order they are configured.
+//
+// The service controller passes every node in the cluster, and which node
+// will host the VIP is decided by keepalived, not the provider, so this only
+// excludes pools that no node can host. The order the pools are configured
+// in decides between the rest, and services that must be in a particular
+// segment should name their pool with an annotation.
+func (k *KeepalivedLoadBalancer) candidatePools(sc serviceConfig, nodes []*v1.Node) ([]*pool, error) {
+	permitted, err := k.permittedPools(sc)
+	if err != nil {
+		return nil, err
+	}
+	if sc.Pool != "" {
+		return permitted, nil
+	}
+
+	var candidates []*pool
+	for _, p := range permitted {
+		for _, n := range nodes {
+			if p.hosts(n, k.topology) {
+				candidates = append(candidates, p)
+				break
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no pool can be hosted on any of the %d nodes", len(nodes))
+	}
+	return candidates, nil
+}
+
+// permittedPools returns the pool named by sc, or otherwise the pools that
+// permit sc's namespace.
+func (k *KeepalivedLoadBalancer) permittedPools(sc serviceConfig) ([]*pool, error) {
+	if sc.Pool != "" {
+		p, ok := k.poolByName(sc.Pool)
+		if !ok {
+			return nil, fmt.Errorf("unknown pool '%s' in annotation %s", sc.Pool, servicePoolAnnotationKey)
+		}
+		return []*pool{p}, nil
+	}
+
+	labels, err := k.namespaceLabels(sc.ServiceNamespace)
+	if err != nil {
+		return nil, err
+	}
+	var permitted []*pool
+	for i := range k.pools {
+		if k.pools[i].permits(sc.ServiceNamespace, labels) {
+			permitted = append(permitted, &k.pools[i])
+		}
+	}
+	if len(permitted) == 0 {
+		return nil, fmt.Errorf("no pool is permitted in namespace '%s'", sc.ServiceNamespace)
+	}
+	return permitted, nil
+}
+
+// allocateFromPools allocates an IP for sc from the first candidate pool
+// with a free address, and within the quota of sc's namespace, returning the
+// IP and pool.
+func (k *KeepalivedLoadBalancer) allocateFromPools(cfg *config, sc serviceConfig, nodes []*v1.Node) (string, *pool, error) {
+	candidates, err := k.candidatePools(sc, nodes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	candidates, err = k.withinQuota(cfg, sc, candidates)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, p := range candidates {
+		ip, err := cfg.allocateIP(p.CIDR)
+		if err == nil {
+			return ip, p, nil
+		}
+		if err != errPoolExhausted {
+			return "", nil, fmt.Errorf("error allocating ip from pool '%s': %s", p.Name, err.Error())
+		}
+	}
+
+	if len(candidates) == 1 {
+		return "", nil, fmt.Errorf("ip pool '%s' exhausted. increase size of cidr or remove some loadbalancers", candidates[0].Name)
+	}
+	return "", nil, fmt.Errorf("all %d candidate ip pools exhausted. increase size of cidrs or remove some loadbalancers", len(candidates))
+}
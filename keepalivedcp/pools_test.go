@@ -0,0 +1,146 @@
+package keepalivedcp
+
+import (
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+func TestAllocateFromPools(t *testing.T) {
+	topo, err := parseTopology([]byte(testTopology))
+	if err != nil {
+		t.Fatalf("got error: %s", err.Error())
+	}
+
+	k := &KeepalivedLoadBalancer{
+		topology: topo,
+		pools: []pool{
+			{Name: "rack-1", CIDR: "10.210.1.0/30", Zone: "rack-1"},
+			{Name: "rack-2", CIDR: "10.210.2.0/30", Zone: "rack-2"},
+			{Name: "ssd", CIDR: "10.210.3.0/30", NodeSelector: map[string]string{"disk": "ssd"}},
+		},
+	}
+
+	node := func(name string, labels map[string]string) *v1.Node {
+		n := &v1.Node{}
+		n.Name = name
+		n.Labels = labels
+		return n
+	}
+
+	// rack-2 is matched by subnet rather than name
+	rack2Node := node("node-7", nil)
+	rack2Node.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.2.7"}}
+
+	type testDef struct {
+		name         string
+		config       config
+		service      serviceConfig
+		nodes        []*v1.Node
+		expectedIP   string
+		expectedPool string
+		err          bool
+	}
+
+	tests := []testDef{
+		{
+			name:         "pool for zone of nodes",
+			nodes:        []*v1.Node{rack2Node},
+			expectedIP:   "10.210.2.1",
+			expectedPool: "rack-2",
+		},
+		{
+			name:         "pool for node selector",
+			nodes:        []*v1.Node{node("node-1", map[string]string{"disk": "ssd"})},
+			expectedIP:   "10.210.3.1",
+			expectedPool: "ssd",
+		},
+		{
+			name:         "first pool in order",
+			nodes:        []*v1.Node{node("r1-node-1", nil), node("node-1", map[string]string{"disk": "ssd"})},
+			expectedIP:   "10.210.1.1",
+			expectedPool: "rack-1",
+		},
+		{
+			name: "next pool when first is exhausted",
+			config: config{
+				Services: []serviceConfig{
+					{UID: "a", IP: "10.210.1.1"},
+					{UID: "b", IP: "10.210.1.2"},
+				},
+			},
+			nodes:        []*v1.Node{node("r1-node-1", nil), node("node-1", map[string]string{"disk": "ssd"})},
+			expectedIP:   "10.210.3.1",
+			expectedPool: "ssd",
+		},
+		{
+			name:         "pool named by annotation",
+			service:      serviceConfig{Pool: "rack-2"},
+			nodes:        []*v1.Node{node("r1-node-1", nil)},
+			expectedIP:   "10.210.2.1",
+			expectedPool: "rack-2",
+		},
+		{
+			name:  "no pool for nodes",
+			nodes: []*v1.Node{node("node-2", nil)},
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				ip, p, err := k.allocateFromPools(&test.config, test.service, test.nodes)
+
+				if err != nil {
+					if test.err {
+						return
+					}
+
+					t.Errorf("got error: %s", err.Error())
+					return
+				}
+
+				if test.err {
+					t.Errorf("expected error but got none")
+					return
+				}
+
+				if ip != test.expectedIP || p.Name != test.expectedPool {
+					t.Errorf("expected IP '%s' from pool '%s' but got '%s' from '%s'", test.expectedIP, test.expectedPool, ip, p.Name)
+				}
+			}
+		}(test))
+	}
+}
+
+func TestValidatePools(t *testing.T) {
+	type testDef struct {
+		name  string
+		pools []pool
+		err   bool
+	}
+
+	tests := []testDef{
+		{name: "valid", pools: []pool{{Name: "a", CIDR: "10.0.0.0/30"}, {Name: "b", CIDR: "10.0.1.0/24"}}},
+		{name: "duplicate name", pools: []pool{{Name: "a", CIDR: "10.0.0.0/30"}, {Name: "a", CIDR: "10.0.1.0/24"}}, err: true},
+		{name: "invalid cidr", pools: []pool{{Name: "a", CIDR: "10.0.0.0"}}, err: true},
+		{name: "no allocatable addresses", pools: []pool{{Name: "a", CIDR: "10.0.0.1/32"}}, err: true},
+		{name: "overlapping cidrs", pools: []pool{{Name: "a", CIDR: "10.0.0.0/24"}, {Name: "b", CIDR: "10.0.0.128/25"}}, err: true},
+		{name: "overlapping larger cidr", pools: []pool{{Name: "a", CIDR: "10.0.0.128/25"}, {Name: "b", CIDR: "10.0.0.0/16"}}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				err := validatePools(test.pools)
+				if err != nil && !test.err {
+					t.Errorf("got error: %s", err.Error())
+				}
+				if err == nil && test.err {
+					t.Errorf("expected error but got none")
+				}
+			}
+		}(test))
+	}
+}
@@ -0,0 +1,140 @@
+package keepalivedcp
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+const eventReasonQuotaExceeded = "QuotaExceeded"
+
+// quotaDefaultNamespace is the namespace of the quota that applies to every
+// namespace without a quota of its own.
+const quotaDefaultNamespace = "*"
+
+// quota limits the number of VIPs that can be allocated to the services in a
+// namespace.
+type quota struct {
+	// Namespace is the namespace the quota applies to, or * for all
+	// namespaces without a quota of their own
+	Namespace string `json:"namespace"`
+	// VIPs is the maximum number of VIPs in the namespace, or unlimited if
+	// unset. 0 allows no VIPs at all, as for a pool in Pools.
+	VIPs *int `json:"vips,omitempty"`
+	// Pools are the maximum number of VIPs in the namespace from each pool,
+	// where 0 allows no VIPs from the pool. Pools that are not listed are
+	// only limited by VIPs.
+	Pools map[string]int `json:"pools,omitempty"`
+}
+
+// validateQuotas checks that quotas have unique namespaces, and only limit
+// pools that exist.
+func validateQuotas(quotas []quota, pools []pool) error {
+	poolNames := map[string]bool{}
+	for _, p := range pools {
+		poolNames[p.Name] = true
+	}
+
+	namespaces := map[string]bool{}
+	for i, q := range quotas {
+		if q.Namespace == "" {
+			return fmt.Errorf("quota %d has no namespace", i)
+		}
+		if namespaces[q.Namespace] {
+			return fmt.Errorf("duplicate quota for namespace '%s'", q.Namespace)
+		}
+		namespaces[q.Namespace] = true
+
+		if q.VIPs != nil && *q.VIPs < 0 {
+			return fmt.Errorf("invalid vips %d in quota for namespace '%s'", *q.VIPs, q.Namespace)
+		}
+		for name, limit := range q.Pools {
+			if !poolNames[name] {
+				return fmt.Errorf("unknown pool '%s' in quota for namespace '%s'", name, q.Namespace)
+			}
+			if limit < 0 {
+				return fmt.Errorf("invalid limit %d for pool '%s' in quota for namespace '%s'", limit, name, q.Namespace)
+			}
+		}
+	}
+	return nil
+}
+
+// quotaExceededError is returned when allocating a VIP would exceed a quota.
+type quotaExceededError struct {
+	msg string
+}
+
+func (e *quotaExceededError) Error() string {
+	return e.msg
+}
+
+// quotaFor returns the quota for namespace, or nil if it is unlimited.
+func (k *KeepalivedLoadBalancer) quotaFor(namespace string) *quota {
+	var def *quota
+	for i := range k.quotas {
+		switch k.quotas[i].Namespace {
+		case namespace:
+			return &k.quotas[i]
+		case quotaDefaultNamespace:
+			def = &k.quotas[i]
+		}
+	}
+	return def
+}
+
+// withinQuota returns the pools out of candidates that a VIP can be
+// allocated to sc from without exceeding the quota of sc's namespace. VIPs
+// already allocated to sc are not counted. A quotaExceededError is returned
+// if the namespace has no VIPs left, or none of the candidates do.
+func (k *KeepalivedLoadBalancer) withinQuota(cfg *config, sc serviceConfig, candidates []*pool) ([]*pool, error) {
+	q := k.quotaFor(sc.ServiceNamespace)
+	if q == nil {
+		return candidates, nil
+	}
+
+	total := 0
+	byPool := map[string]int{}
+	for _, s := range cfg.Services {
+		if s.ServiceNamespace != sc.ServiceNamespace || s.UID == sc.UID {
+			continue
+		}
+		total++
+		byPool[s.Pool]++
+	}
+
+	if q.VIPs != nil && total >= *q.VIPs {
+		return nil, &quotaExceededError{fmt.Sprintf("namespace '%s' has used all of its quota of %d vips", sc.ServiceNamespace, *q.VIPs)}
+	}
+
+	var allowed []*pool
+	for _, p := range candidates {
+		limit, ok := q.Pools[p.Name]
+		if ok && byPool[p.Name] >= limit {
+			continue
+		}
+		allowed = append(allowed, p)
+	}
+
+	if len(candidates) > 0 && len(allowed) == 0 {
+		if len(candidates) == 1 {
+			return nil, &quotaExceededError{fmt.Sprintf("namespace '%s' has used all of its quota of %d vips in pool '%s'", sc.ServiceNamespace, q.Pools[candidates[0].Name], candidates[0].Name)}
+		}
+		return nil, &quotaExceededError{fmt.Sprintf("namespace '%s' has used all of its quota in each of the %d candidate pools", sc.ServiceNamespace, len(candidates))}
+	}
+	return allowed, nil
+}
+
+// rejectOverQuota reports that a VIP was not allocated to service, if err is
+// a quotaExceededError.
+func (k *KeepalivedLoadBalancer) rejectOverQuota(service *v1.Service, err error) {
+	if _, ok := err.(*quotaExceededError); !ok {
+		return
+	}
+	glog.Warningf("not allocating vip to service '%s/%s': %s", service.Namespace, service.Name, err.Error())
+	quotaRejectionsMetric.WithLabelValues(service.Namespace).Inc()
+	k.recordEventf(service, apiv1.EventTypeWarning, eventReasonQuotaExceeded, "Not allocating a VIP: %s", err.Error())
+}
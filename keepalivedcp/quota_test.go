@@ -0,0 +1,138 @@
+package keepalivedcp
+
+import (
+	"testing"
+)
+
+func TestWithinQuota(t *testing.T) {
+	type testDef struct {
+		name      string
+		namespace string
+		uid       string
+		expected  []string
+		expectErr bool
+	}
+
+	k := NewKeepalivedLoadBalancer(nil, nil, "", "", "", "", "")
+	k.pools = []pool{
+		{Name: "a", CIDR: "10.0.0.0/24"},
+		{Name: "b", CIDR: "10.0.1.0/24"},
+	}
+	k.quotas = []quota{
+		{Namespace: "limited", VIPs: intPtr(2)},
+		{Namespace: "pool-limited", Pools: map[string]int{"a": 1}},
+		{Namespace: "denied", VIPs: intPtr(0)},
+		{Namespace: "pool-denied", Pools: map[string]int{"a": 0}},
+		{Namespace: quotaDefaultNamespace, VIPs: intPtr(1)},
+	}
+	candidates := []*pool{&k.pools[0], &k.pools[1]}
+
+	cfg := &config{
+		Services: []serviceConfig{
+			{UID: "1", IP: "10.0.0.1", ServiceNamespace: "limited", Pool: "a"},
+			{UID: "2", IP: "10.0.1.1", ServiceNamespace: "limited", Pool: "b"},
+			{UID: "3", IP: "10.0.0.2", ServiceNamespace: "pool-limited", Pool: "a"},
+			{UID: "4", IP: "10.0.0.3", ServiceNamespace: "other", Pool: "a"},
+		},
+	}
+
+	tests := []testDef{
+		{
+			name:      "namespace quota used",
+			namespace: "limited",
+			uid:       "5",
+			expectErr: true,
+		},
+		{
+			name:      "service already counted",
+			namespace: "limited",
+			uid:       "1",
+			expected:  []string{"a", "b"},
+		},
+		{
+			name:      "pool quota used",
+			namespace: "pool-limited",
+			uid:       "5",
+			expected:  []string{"b"},
+		},
+		{
+			name:      "no vips allowed",
+			namespace: "denied",
+			uid:       "5",
+			expectErr: true,
+		},
+		{
+			name:      "no vips allowed from pool",
+			namespace: "pool-denied",
+			uid:       "5",
+			expected:  []string{"b"},
+		},
+		{
+			name:      "default quota used",
+			namespace: "other",
+			uid:       "5",
+			expectErr: true,
+		},
+		{
+			name:      "default quota available",
+			namespace: "new",
+			uid:       "5",
+			expected:  []string{"a", "b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				allowed, err := k.withinQuota(cfg, serviceConfig{UID: test.uid, ServiceNamespace: test.namespace}, candidates)
+				if err != nil {
+					if _, ok := err.(*quotaExceededError); !ok {
+						t.Errorf("expected quotaExceededError but got %T", err)
+					}
+					if !test.expectErr {
+						t.Errorf("unexpected error: %s", err.Error())
+					}
+					return
+				}
+				if test.expectErr {
+					t.Errorf("expected error but got none")
+					return
+				}
+				var names []string
+				for _, p := range allowed {
+					names = append(names, p.Name)
+				}
+				if len(names) != len(test.expected) {
+					t.Errorf("expected pools %v but got %v", test.expected, names)
+					return
+				}
+				for i := range names {
+					if names[i] != test.expected[i] {
+						t.Errorf("expected pools %v but got %v", test.expected, names)
+					}
+				}
+			}
+		}(test))
+	}
+}
+
+func TestValidateQuotas(t *testing.T) {
+	pools := []pool{{Name: "a", CIDR: "10.0.0.0/24"}}
+
+	if err := validateQuotas([]quota{{Namespace: "x", VIPs: intPtr(1), Pools: map[string]int{"a": 1}}}, pools); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if err := validateQuotas([]quota{{Namespace: "x", Pools: map[string]int{"b": 1}}}, pools); err == nil {
+		t.Errorf("expected error for unknown pool")
+	}
+	if err := validateQuotas([]quota{{Namespace: "x"}, {Namespace: "x"}}, pools); err == nil {
+		t.Errorf("expected error for duplicate namespace")
+	}
+	if err := validateQuotas([]quota{{Namespace: "x", VIPs: intPtr(-1)}}, pools); err == nil {
+		t.Errorf("expected error for negative vips")
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,191 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+// corruptConfigAnnotationKey is the annotation that a config annotation that
+// could not be decoded is moved to when the config is recovered, so that it
+// can be inspected.
+const corruptConfigAnnotationKey = "k8s.co/cloud-provider-config-corrupt"
+
+const (
+	eventReasonAllocationConflict = "AllocationConflict"
+	eventReasonCorruptConfig      = "CorruptLoadBalancerConfig"
+)
+
+// allocationConflict is an IP in the ingress status of more than one service.
+type allocationConflict struct {
+	IP       string
+	Services []*apiv1.Service
+}
+
+func (c allocationConflict) String() string {
+	names := make([]string, len(c.Services))
+	for i, s := range c.Services {
+		names[i] = s.Namespace + "/" + s.Name
+	}
+	return fmt.Sprintf("ip %s is used by %s", c.IP, strings.Join(names, ", "))
+}
+
+// recoverFromServices rebuilds the config from the ingress IPs in the status
+// of the live services, if the config annotation is missing or cannot be
+// decoded. It returns true if the config was recovered.
+func (k *KeepalivedLoadBalancer) recoverFromServices() (bool, error) {
+	cm, err := k.getConfigMap()
+
+	if err != nil {
+		return false, err
+	}
+
+	raw, ok := cm.Annotations[configMapAnnotationKey]
+	if ok {
+		_, err := configFrom(cm)
+		if err == nil {
+			return false, nil
+		}
+		glog.Errorf("recovering config for configmap %s/%s from service status: %s", k.namespace, k.name, err.Error())
+		cm.Annotations[corruptConfigAnnotationKey] = raw
+	} else {
+		glog.Warningf("recovering config for configmap %s/%s from service status: config annotation is missing", k.namespace, k.name)
+	}
+
+	list, err := k.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return false, fmt.Errorf("error listing services: %s", err.Error())
+	}
+
+	cfg, conflicts := k.configFromServices(list.Items)
+	for _, c := range conflicts {
+		glog.Errorf("not recovering conflicting allocation, reserving it instead: %s", c)
+		if k.recorder == nil {
+			continue
+		}
+		for _, s := range c.Services {
+			k.recorder.Eventf(s, apiv1.EventTypeWarning, eventReasonAllocationConflict, "Not recovering conflicting allocation: %s", c)
+		}
+	}
+	glog.Infof("recovered %d allocations from service status, reserved %d conflicting ips", len(cfg.Services), len(cfg.Reserved))
+
+	// entries that were not recovered, eg. written by hand for services of
+	// other types, are kept as they are rather than wiped
+	if k.configFormat == configFormatVIP {
+		for ip, v := range cm.Data {
+			if _, ok := ipHolder(cfg, serviceConfig{IP: ip}); ok {
+				continue
+			}
+			glog.Warningf("keeping configmap entry '%s: %s' that was not recovered unmanaged and reserving its ip", ip, v)
+			cfg.keepUnmanaged(ip, v)
+		}
+	}
+
+	if cm.Data, err = k.configMapData(cfg); err != nil {
+		return false, err
+	}
+	if err := k.updateConfigMap(cm, cfg); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// loadConfig returns the keepalived ConfigMap and the config in it, to sync
+// service. If the config annotation cannot be decoded, the config is
+// recovered from service status if recoverFromStatus is set, and otherwise an
+// event naming the ctl command that recovers it is recorded against the
+// ConfigMap and service.
+func (k *KeepalivedLoadBalancer) loadConfig(service *v1.Service) (*apiv1.ConfigMap, *config, error) {
+	cm, err := k.getConfigMap()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err := configFrom(cm)
+
+	if err == nil {
+		return cm, cfg, nil
+	}
+
+	if !k.recoverFromStatus {
+		glog.Errorf("config of configmap %s/%s is corrupt, run 'keepalived-cloud-provider ctl recover' to recover it from service status: %s", k.namespace, k.name, err.Error())
+		if k.recorder != nil {
+			k.recorder.Eventf(cm, apiv1.EventTypeWarning, eventReasonCorruptConfig, "Config is corrupt, run 'keepalived-cloud-provider ctl recover' to recover it from service status: %s", err.Error())
+		}
+		k.recordEventf(service, apiv1.EventTypeWarning, eventReasonCorruptConfig, "Config in configmap %s/%s is corrupt, run 'keepalived-cloud-provider ctl recover' to recover it from service status", k.namespace, k.name)
+		return nil, nil, err
+	}
+
+	if _, err := k.recoverFromServices(); err != nil {
+		return nil, nil, fmt.Errorf("error recovering config from service status: %s", err.Error())
+	}
+
+	cm, err = k.getConfigMap()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err = configFrom(cm)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cm, cfg, nil
+}
+
+// configFromServices builds a config allocating the ingress IP of each
+// LoadBalancer service, out of those within one of the provider's pools, to
+// the service. IPs used by more than one service are not allocated to any of
+// them, but are reserved and returned as conflicts to be resolved by hand.
+func (k *KeepalivedLoadBalancer) configFromServices(services []apiv1.Service) (*config, []allocationConflict) {
+	byIP := map[string][]*apiv1.Service{}
+	for i := range services {
+		svc := &services[i]
+		if svc.Spec.Type != apiv1.ServiceTypeLoadBalancer {
+			continue
+		}
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if _, ok := k.poolContaining(ingress.IP); ok {
+				byIP[ingress.IP] = append(byIP[ingress.IP], svc)
+				break
+			}
+		}
+	}
+
+	ips := make([]string, 0, len(byIP))
+	for ip := range byIP {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	cfg := &config{Version: currentConfigVersion}
+	var conflicts []allocationConflict
+	for _, ip := range ips {
+		svcs := byIP[ip]
+		if len(svcs) > 1 {
+			conflicts = append(conflicts, allocationConflict{IP: ip, Services: svcs})
+			cfg.Reserved = append(cfg.Reserved, ip)
+			continue
+		}
+
+		p, _ := k.poolContaining(ip)
+		cfg.ensureService(serviceConfig{
+			UID:              string(svcs[0].UID),
+			IP:               ip,
+			ServiceNamespace: svcs[0].Namespace,
+			ServiceName:      svcs[0].Name,
+			Pool:             p.Name,
+			Zone:             p.Zone,
+		})
+	}
+	return cfg, conflicts
+}
@@ -0,0 +1,59 @@
+package keepalivedcp
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestConfigFromServices(t *testing.T) {
+	service := func(name string, typ apiv1.ServiceType, ips ...string) apiv1.Service {
+		svc := apiv1.Service{}
+		svc.Namespace = "default"
+		svc.Name = name
+		svc.UID = types.UID("uid-" + name)
+		svc.Spec.Type = typ
+		for _, ip := range ips {
+			svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, apiv1.LoadBalancerIngress{IP: ip})
+		}
+		return svc
+	}
+
+	services := []apiv1.Service{
+		service("a", apiv1.ServiceTypeLoadBalancer, "10.0.0.1"),
+		service("b", apiv1.ServiceTypeLoadBalancer, "10.0.1.1"),
+		service("conflict-1", apiv1.ServiceTypeLoadBalancer, "10.0.0.2"),
+		service("conflict-2", apiv1.ServiceTypeLoadBalancer, "10.0.0.2"),
+		service("foreign", apiv1.ServiceTypeLoadBalancer, "192.168.0.1", "10.0.0.3"),
+		service("outside", apiv1.ServiceTypeLoadBalancer, "192.168.0.2"),
+		service("pending", apiv1.ServiceTypeLoadBalancer),
+		service("nodeport", apiv1.ServiceTypeNodePort, "10.0.0.4"),
+	}
+
+	k := NewKeepalivedLoadBalancer(nil, nil, "", "", "", "", "")
+	k.pools = []pool{
+		{Name: "a", CIDR: "10.0.0.0/24"},
+		{Name: "b", CIDR: "10.0.1.0/24", Zone: "rack-2"},
+	}
+
+	cfg, conflicts := k.configFromServices(services)
+
+	expected := []serviceConfig{
+		{UID: "uid-a", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "a", Pool: "a"},
+		{UID: "uid-foreign", IP: "10.0.0.3", ServiceNamespace: "default", ServiceName: "foreign", Pool: "a"},
+		{UID: "uid-b", IP: "10.0.1.1", ServiceNamespace: "default", ServiceName: "b", Pool: "b", Zone: "rack-2"},
+	}
+	if !reflect.DeepEqual(cfg.Services, expected) {
+		t.Errorf("expected services %v but got %v", expected, cfg.Services)
+	}
+
+	if !reflect.DeepEqual(cfg.Reserved, []string{"10.0.0.2"}) {
+		t.Errorf("expected 10.0.0.2 to be reserved but got %v", cfg.Reserved)
+	}
+
+	if len(conflicts) != 1 || conflicts[0].String() != "ip 10.0.0.2 is used by default/conflict-1, default/conflict-2" {
+		t.Errorf("unexpected conflicts: %v", conflicts)
+	}
+}
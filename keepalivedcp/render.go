@@ -0,0 +1,194 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// configFormatHAProxy writes a haproxy.cfg forwarding every service
+	// under haproxyConfKey
+	configFormatHAProxy = "haproxy"
+	// configFormatEnvoy writes the static resources of an Envoy bootstrap
+	// forwarding every service under envoyConfKey
+	configFormatEnvoy = "envoy"
+)
+
+// renderer renders a config into the data of the keepalived ConfigMap.
+type renderer interface {
+	render(cfg *config) (map[string]string, error)
+}
+
+// renderers are the renderers for each config format.
+var renderers = map[string]renderer{
+	configFormatVIP:        vipRenderer{},
+	configFormatKeepalived: keepalivedRenderer{},
+	configFormatHAProxy:    haproxyRenderer{},
+	configFormatEnvoy:      envoyRenderer{},
+}
+
+// validateConfigFormat returns an error if there is no renderer for format.
+func validateConfigFormat(format string) error {
+	if _, ok := renderers[format]; ok {
+		return nil
+	}
+	formats := make([]string, 0, len(renderers))
+	for f := range renderers {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return fmt.Errorf("invalid config format '%s': must be one of %s", format, strings.Join(formats, ", "))
+}
+
+// isProxyFormat returns true if services in format are forwarded by a proxy
+// rather than IPVS, and so can use its L7 features.
+func isProxyFormat(format string) bool {
+	return format == configFormatHAProxy || format == configFormatEnvoy
+}
+
+// vipRenderer writes one entry per service for kube-keepalived-vip.
+type vipRenderer struct{}
+
+func (vipRenderer) render(cfg *config) (map[string]string, error) {
+	return cfg.toConfigMapData(), nil
+}
+
+// keepalivedRenderer writes a keepalived.conf, and a haproxy.cfg for the
+// services that use the PROXY protocol, which IPVS cannot send.
+type keepalivedRenderer struct{}
+
+func (keepalivedRenderer) render(cfg *config) (map[string]string, error) {
+	data := map[string]string{keepalivedConfKey: cfg.toKeepalivedConf()}
+	var proxied []serviceConfig
+	for _, s := range cfg.Services {
+		if s.ProxyProtocol != "" {
+			proxied = append(proxied, s)
+		}
+	}
+	if len(proxied) > 0 {
+		data[haproxyConfKey] = renderHAProxy(proxied, cfg.Nodes)
+	}
+	return data, nil
+}
+
+// haproxyRenderer writes a haproxy.cfg forwarding every service.
+type haproxyRenderer struct{}
+
+func (haproxyRenderer) render(cfg *config) (map[string]string, error) {
+	return map[string]string{haproxyConfKey: renderHAProxy(cfg.Services, cfg.Nodes)}, nil
+}
+
+// envoyRenderer writes Envoy static resources forwarding every service.
+type envoyRenderer struct{}
+
+func (envoyRenderer) render(cfg *config) (map[string]string, error) {
+	conf, err := renderEnvoy(cfg.Services, cfg.Nodes)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{envoyConfKey: conf}, nil
+}
+
+// listener is a VIP and port that one or more services are forwarded from.
+// Services sharing a listener are routed by the SNI hostname of TLS
+// connections, with the first service without SNI hostnames, if any, as the
+// default.
+type listener struct {
+	IP       string
+	Port     int32
+	Services []listenerService
+}
+
+// listenerService is the port of a service forwarded from a listener.
+type listenerService struct {
+	serviceConfig
+	Port servicePort
+}
+
+// name returns a name for the service's port that is unique in a config.
+func (s listenerService) name() string {
+	return fmt.Sprintf("%s_%s_%d", s.ServiceNamespace, s.ServiceName, s.Port.Port)
+}
+
+func (l listener) name() string {
+	return fmt.Sprintf("vip_%s_%d", l.IP, l.Port)
+}
+
+// routed returns true if the services of the listener are routed by SNI.
+func (l listener) routed() bool {
+	for _, s := range l.Services {
+		if len(s.SNIHostnames) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultService returns the service that connections not matching any SNI
+// hostname are forwarded to.
+func (l listener) defaultService() (listenerService, bool) {
+	for _, s := range l.Services {
+		if len(s.SNIHostnames) == 0 {
+			return s, true
+		}
+	}
+	return listenerService{}, false
+}
+
+// listeners groups the TCP ports of services by VIP and port, in the order
+// they first appear.
+func listeners(services []serviceConfig) []listener {
+	var ls []listener
+	index := map[string]int{}
+	for _, s := range services {
+		for _, p := range s.Ports {
+			if p.Protocol != "TCP" {
+				continue
+			}
+			key := fmt.Sprintf("%s:%d", s.IP, p.Port)
+			i, ok := index[key]
+			if !ok {
+				i = len(ls)
+				index[key] = i
+				ls = append(ls, listener{IP: s.IP, Port: p.Port})
+			}
+			ls[i].Services = append(ls[i].Services, listenerService{s, p})
+		}
+	}
+	return ls
+}
+
+// checkSharing returns an error if sc cannot share its VIP with the other
+// services in cfg that it is allocated to. Each entry of the vip format is
+// for a whole VIP, so it cannot be shared. Otherwise, each port of a VIP is
+// forwarded to at most one service without SNI hostnames, and each SNI
+// hostname on a port is claimed by at most one service.
+func (k *KeepalivedLoadBalancer) checkSharing(cfg *config, sc serviceConfig) error {
+	for _, s := range cfg.Services {
+		if s.IP != sc.IP || s.UID == sc.UID {
+			continue
+		}
+		if k.configFormat == configFormatVIP {
+			return fmt.Errorf("vip %s is already allocated to service %s/%s", sc.IP, s.ServiceNamespace, s.ServiceName)
+		}
+		for _, p := range sc.Ports {
+			for _, q := range s.Ports {
+				if p.Port != q.Port || p.Protocol != q.Protocol {
+					continue
+				}
+				if len(sc.SNIHostnames) == 0 && len(s.SNIHostnames) == 0 {
+					return fmt.Errorf("port %d of vip %s is already forwarded to service %s/%s without sni hostnames", p.Port, sc.IP, s.ServiceNamespace, s.ServiceName)
+				}
+				for _, h := range sc.SNIHostnames {
+					for _, other := range s.SNIHostnames {
+						if h == other {
+							return fmt.Errorf("sni hostname '%s' on port %d of vip %s is already claimed by service %s/%s", h, p.Port, sc.IP, s.ServiceNamespace, s.ServiceName)
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package keepalivedcp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+// routeStore persists the desired routes, as a map of node name to the
+// node's pod CIDR.
+type routeStore interface {
+	load() (map[string]string, error)
+	save(map[string]string) error
+}
+
+// routeBackend programs the desired routes into the network.
+type routeBackend interface {
+	// apply is called with the complete set of desired routes after every
+	// change to them.
+	apply(routes map[string]string) error
+}
+
+// routes implements cloudprovider.Routes with one route per node, to the
+// node's pod CIDR. Routes are kept in a declarative store, and applied by an
+// optional backend after every change.
+type routes struct {
+	store   routeStore
+	backend routeBackend
+	// dryRun causes changes to the routes to be logged but not applied or
+	// saved
+	dryRun bool
+	// mu serializes changes to the store
+	mu sync.Mutex
+}
+
+var _ cloudprovider.Routes = &routes{}
+
+// ListRoutes lists all managed routes that belong to the specified clusterName
+func (r *routes) ListRoutes(clusterName string) ([]*cloudprovider.Route, error) {
+	desired, err := r.store.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*cloudprovider.Route
+	for node, cidr := range desired {
+		list = append(list, &cloudprovider.Route{
+			Name:            node,
+			TargetNode:      types.NodeName(node),
+			DestinationCIDR: cidr,
+		})
+	}
+	sort.Sort(routesByName(list))
+	return list, nil
+}
+
+// CreateRoute creates the described managed route
+func (r *routes) CreateRoute(clusterName string, nameHint string, route *cloudprovider.Route) error {
+	glog.Infof("creating route to %s via node '%s'", route.DestinationCIDR, route.TargetNode)
+	return r.update(func(desired map[string]string) {
+		desired[string(route.TargetNode)] = route.DestinationCIDR
+	})
+}
+
+// DeleteRoute deletes the specified managed route
+func (r *routes) DeleteRoute(clusterName string, route *cloudprovider.Route) error {
+	glog.Infof("deleting route to %s via node '%s'", route.DestinationCIDR, route.TargetNode)
+	return r.update(func(desired map[string]string) {
+		if desired[string(route.TargetNode)] == route.DestinationCIDR {
+			delete(desired, string(route.TargetNode))
+		}
+	})
+}
+
+func (r *routes) update(f func(map[string]string)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	desired, err := r.store.load()
+	if err != nil {
+		return err
+	}
+
+	f(desired)
+
+	if r.dryRun {
+		glog.Infof("dry run: not applying or saving routes: %v", desired)
+		return nil
+	}
+
+	// apply before saving, so that a failed apply leaves the store as it
+	// was and the change is retried
+	if r.backend != nil {
+		if err := r.backend.apply(desired); err != nil {
+			return err
+		}
+	}
+	return r.store.save(desired)
+}
+
+type routesByName []*cloudprovider.Route
+
+func (r routesByName) Len() int           { return len(r) }
+func (r routesByName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r routesByName) Less(i, j int) bool { return r[i].Name < r[j].Name }
+
+// memoryRouteStore keeps routes in memory. It is not persisted, and is
+// intended for testing.
+type memoryRouteStore map[string]string
+
+func (m memoryRouteStore) load() (map[string]string, error) {
+	desired := make(map[string]string, len(m))
+	for k, v := range m {
+		desired[k] = v
+	}
+	return desired, nil
+}
+
+func (m memoryRouteStore) save(desired map[string]string) error {
+	for k := range m {
+		delete(m, k)
+	}
+	for k, v := range desired {
+		m[k] = v
+	}
+	return nil
+}
+
+// configMapRouteStore keeps routes in the data of a ConfigMap, keyed by node
+// name. Agents running on each node, eg. programming routes with netlink,
+// can watch the ConfigMap to apply them.
+type configMapRouteStore struct {
+	kubeClient      kubernetes.Interface
+	namespace, name string
+}
+
+func (c *configMapRouteStore) load() (map[string]string, error) {
+	cm, err := c.kubeClient.CoreV1().ConfigMaps(c.namespace).Get(c.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting routes configmap: %s", err.Error())
+	}
+
+	desired := make(map[string]string, len(cm.Data))
+	for k, v := range cm.Data {
+		desired[k] = v
+	}
+	return desired, nil
+}
+
+func (c *configMapRouteStore) save(desired map[string]string) error {
+	cm, err := c.kubeClient.CoreV1().ConfigMaps(c.namespace).Get(c.name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting routes configmap: %s", err.Error())
+	}
+
+	cm.Data = desired
+	if _, err := c.kubeClient.CoreV1().ConfigMaps(c.namespace).Update(cm); err != nil {
+		return fmt.Errorf("error updating routes configmap: %s", err.Error())
+	}
+	return nil
+}
+
+// staticRouteFile writes the routes as a BIRD static protocol, for BIRD to
+// announce over BGP. The gateway of each route is the node's internal
+// address.
+type staticRouteFile struct {
+	path string
+	// nodeAddress returns the address to route a node's pod CIDR via, or
+	// an empty string if the node has none
+	nodeAddress func(node string) (string, error)
+}
+
+func newStaticRouteFile(kubeClient kubernetes.Interface, path string) *staticRouteFile {
+	return &staticRouteFile{
+		path: path,
+		nodeAddress: func(name string) (string, error) {
+			node, err := kubeClient.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+			if err != nil {
+				return "", fmt.Errorf("error getting node '%s': %s", name, err.Error())
+			}
+			for _, a := range node.Status.Addresses {
+				if a.Type == apiv1.NodeInternalIP {
+					return a.Address, nil
+				}
+			}
+			return "", nil
+		},
+	}
+}
+
+func (s *staticRouteFile) apply(routes map[string]string) error {
+	nodes := make([]string, 0, len(routes))
+	for node := range routes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# generated by %s, do not edit\n", eventSourceComponent)
+	fmt.Fprintf(&b, "protocol static kubernetes_pods {\n")
+	for _, node := range nodes {
+		addr, err := s.nodeAddress(node)
+		if err != nil {
+			return err
+		}
+		if addr == "" {
+			glog.Warningf("not routing %s via node '%s': node has no internal address", routes[node], node)
+			continue
+		}
+		fmt.Fprintf(&b, "    route %s via %s; # %s\n", routes[node], addr, node)
+	}
+	fmt.Fprintf(&b, "}\n")
+
+	// write to a temporary file and rename it, so that readers never see a
+	// partially written file
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return fmt.Errorf("error creating static route file: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing static route file: %s", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing static route file: %s", err.Error())
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("error writing static route file: %s", err.Error())
+	}
+	return nil
+}
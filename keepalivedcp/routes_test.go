@@ -0,0 +1,119 @@
+package keepalivedcp
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+type memoryRouteBackend struct {
+	applied map[string]string
+	err     error
+}
+
+func (m *memoryRouteBackend) apply(routes map[string]string) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.applied = routes
+	return nil
+}
+
+func TestRoutes(t *testing.T) {
+	backend := &memoryRouteBackend{}
+	r := &routes{store: memoryRouteStore{}, backend: backend}
+
+	for _, route := range []*cloudprovider.Route{
+		{TargetNode: "node-2", DestinationCIDR: "10.244.2.0/24"},
+		{TargetNode: "node-1", DestinationCIDR: "10.244.1.0/24"},
+	} {
+		if err := r.CreateRoute("kubernetes", "", route); err != nil {
+			t.Fatalf("got error: %s", err.Error())
+		}
+	}
+
+	list, err := r.ListRoutes("kubernetes")
+	if err != nil {
+		t.Fatalf("got error: %s", err.Error())
+	}
+	expected := []*cloudprovider.Route{
+		{Name: "node-1", TargetNode: "node-1", DestinationCIDR: "10.244.1.0/24"},
+		{Name: "node-2", TargetNode: "node-2", DestinationCIDR: "10.244.2.0/24"},
+	}
+	if !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected routes %v but got %v", expected, list)
+	}
+
+	// deleting a stale route must not remove the node's current route
+	if err := r.DeleteRoute("kubernetes", &cloudprovider.Route{TargetNode: "node-1", DestinationCIDR: "10.244.9.0/24"}); err != nil {
+		t.Fatalf("got error: %s", err.Error())
+	}
+	if err := r.DeleteRoute("kubernetes", list[1]); err != nil {
+		t.Fatalf("got error: %s", err.Error())
+	}
+
+	expectedApplied := map[string]string{"node-1": "10.244.1.0/24"}
+	if !reflect.DeepEqual(backend.applied, expectedApplied) {
+		t.Errorf("expected applied routes %v but got %v", expectedApplied, backend.applied)
+	}
+}
+
+func TestRoutesApplyFailure(t *testing.T) {
+	store := memoryRouteStore{}
+	r := &routes{store: store, backend: &memoryRouteBackend{err: errors.New("unreachable")}}
+
+	if err := r.CreateRoute("kubernetes", "", &cloudprovider.Route{TargetNode: "node-1", DestinationCIDR: "10.244.1.0/24"}); err == nil {
+		t.Fatalf("expected error but got none")
+	}
+	if len(store) != 0 {
+		t.Errorf("expected failed route not to be stored but got %v", store)
+	}
+}
+
+func TestStaticRouteFileSkipsNodesWithoutAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatalf("error creating directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	f := &staticRouteFile{
+		path: filepath.Join(dir, "routes.conf"),
+		nodeAddress: func(node string) (string, error) {
+			if node == "node-1" {
+				return "192.168.0.1", nil
+			}
+			return "", nil
+		},
+	}
+	if err := f.apply(map[string]string{"node-1": "10.244.1.0/24", "node-2": "10.244.2.0/24"}); err != nil {
+		t.Fatalf("got error: %s", err.Error())
+	}
+
+	out, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		t.Fatalf("error reading routes: %s", err.Error())
+	}
+	if !strings.Contains(string(out), "route 10.244.1.0/24 via 192.168.0.1;") || strings.Contains(string(out), "node-2") {
+		t.Errorf("expected only the route via node-1 but got:\n%s", out)
+	}
+}
+
+func TestRoutesDryRun(t *testing.T) {
+	store := memoryRouteStore{}
+	backend := &memoryRouteBackend{}
+	r := &routes{store: store, backend: backend, dryRun: true}
+
+	if err := r.CreateRoute("kubernetes", "", &cloudprovider.Route{TargetNode: "node-1", DestinationCIDR: "10.244.1.0/24"}); err != nil {
+		t.Fatalf("got error: %s", err.Error())
+	}
+	if len(store) != 0 || backend.applied != nil {
+		t.Errorf("expected no routes to be stored or applied but got %v and %v", store, backend.applied)
+	}
+}
@@ -0,0 +1,67 @@
+package keepalivedcp
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// currentConfigVersion is the version of the config schema written by this
+// version of the provider. It must be incremented, and a migration added to
+// configMigrations, whenever a change is made to config or serviceConfig that
+// older versions would not decode correctly.
+const currentConfigVersion = 1
+
+// configMigrations upgrade the raw JSON of a config from the version it is
+// keyed by to the next version.
+var configMigrations = map[int]func(map[string]interface{}) error{
+	// configs written before the version field was introduced have the
+	// same schema as version 1
+	0: func(map[string]interface{}) error { return nil },
+}
+
+// decodeConfig decodes a config of any known version, upgrading it to
+// currentConfigVersion in place. Configs written by a newer version of the
+// provider are refused, as decoding them could silently drop fields and lose
+// allocations when the config is written back.
+func decodeConfig(data []byte) (*config, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	version := 0
+	if v, ok := raw["version"]; ok {
+		f, ok := v.(float64)
+		if !ok || f != float64(int(f)) || f < 0 {
+			return nil, fmt.Errorf("invalid config version '%v'", v)
+		}
+		version = int(f)
+	}
+
+	if version > currentConfigVersion {
+		return nil, fmt.Errorf("config version %d is newer than the latest supported version %d", version, currentConfigVersion)
+	}
+
+	if version < currentConfigVersion {
+		for v := version; v < currentConfigVersion; v++ {
+			if err := configMigrations[v](raw); err != nil {
+				return nil, fmt.Errorf("error upgrading config from version %d: %s", v, err.Error())
+			}
+		}
+		glog.Infof("upgraded config from version %d to %d", version, currentConfigVersion)
+		raw["version"] = currentConfigVersion
+
+		var err error
+		if data, err = json.Marshal(raw); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := config{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
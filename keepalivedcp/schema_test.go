@@ -0,0 +1,98 @@
+package keepalivedcp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecodeConfig(t *testing.T) {
+	type testDef struct {
+		name      string
+		data      string
+		expectErr bool
+		services  int
+	}
+
+	tests := []testDef{
+		{
+			name:     "legacy config without version",
+			data:     `{"services":[{"uid":"1","ip":"10.0.0.1","serviceNamespace":"default","serviceName":"a"}]}`,
+			services: 1,
+		},
+		{
+			name:     "current version",
+			data:     `{"version":1,"services":[{"uid":"1","ip":"10.0.0.1","serviceNamespace":"default","serviceName":"a"}]}`,
+			services: 1,
+		},
+		{
+			name:      "newer version",
+			data:      `{"version":2,"services":[]}`,
+			expectErr: true,
+		},
+		{
+			name:      "invalid version",
+			data:      `{"version":"one","services":[]}`,
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				cfg, err := decodeConfig([]byte(test.data))
+				if err != nil {
+					if !test.expectErr {
+						t.Errorf("unexpected error: %s", err.Error())
+					}
+					return
+				}
+				if test.expectErr {
+					t.Errorf("expected error but got none")
+					return
+				}
+				if cfg.Version != currentConfigVersion {
+					t.Errorf("expected version %d but got %d", currentConfigVersion, cfg.Version)
+				}
+				if len(cfg.Services) != test.services {
+					t.Errorf("expected %d services but got %d", test.services, len(cfg.Services))
+				}
+			}
+		}(test))
+	}
+}
+
+func TestMigrateState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepalived-migrate")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	from := fileStateStore(filepath.Join(dir, "from.json"))
+	to := fileStateStore(filepath.Join(dir, "to.json"))
+
+	cfg := &config{
+		Services: []serviceConfig{{UID: "1", IP: "10.0.0.1", ServiceNamespace: "default", ServiceName: "a"}},
+		Reserved: []string{"10.0.0.5"},
+	}
+	if err := from.save(cfg); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	migrated, err := migrateState(from, to, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := sameAllocations(cfg, migrated); err != nil {
+		t.Errorf("unexpected difference: %s", err.Error())
+	}
+
+	if _, err := migrateState(from, to, false); err == nil {
+		t.Errorf("expected error migrating to a store with allocations")
+	}
+	if _, err := migrateState(from, to, true); err != nil {
+		t.Errorf("unexpected error with force: %s", err.Error())
+	}
+}
@@ -0,0 +1,261 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// stateStore is a storage backend for the config. The controller itself
+// always uses the annotation of its ConfigMap, other backends are used to
+// move and back up the config.
+type stateStore interface {
+	load() (*config, error)
+	save(*config) error
+	String() string
+}
+
+// newStateStore returns the store described by spec, which is one of:
+//
+//	configmap:<namespace>/<name>  the config annotation of a keepalived ConfigMap
+//	secret:<namespace>/<name>     a key in a Secret, which is created if it does not exist
+//	file:<path>                   a JSON file
+func newStateStore(kubeClient kubernetes.Interface, spec, configFormat string) (stateStore, error) {
+	switch {
+	case strings.HasPrefix(spec, "configmap:"):
+		parts := strings.Split(strings.TrimPrefix(spec, "configmap:"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid store '%s': expected configmap:<namespace>/<name>", spec)
+		}
+		return &configMapStateStore{NewKeepalivedLoadBalancer(kubeClient, nil, parts[0], parts[1], "", "", configFormat)}, nil
+	case strings.HasPrefix(spec, "secret:"):
+		parts := strings.Split(strings.TrimPrefix(spec, "secret:"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid store '%s': expected secret:<namespace>/<name>", spec)
+		}
+		return &secretStateStore{kubeClient, parts[0], parts[1]}, nil
+	case strings.HasPrefix(spec, "file:"):
+		return fileStateStore(strings.TrimPrefix(spec, "file:")), nil
+	}
+	return nil, fmt.Errorf("invalid store '%s': must be one of configmap:<namespace>/<name>, secret:<namespace>/<name> or file:<path>", spec)
+}
+
+// configMapStateStore stores the config in the annotation of a ConfigMap,
+// rendering the ConfigMap's data from it as the controller does.
+type configMapStateStore struct {
+	lb *KeepalivedLoadBalancer
+}
+
+func (c *configMapStateStore) load() (*config, error) {
+	cm, err := c.lb.getConfigMap()
+	if err != nil {
+		return nil, err
+	}
+	return configFrom(cm)
+}
+
+func (c *configMapStateStore) save(cfg *config) error {
+	cm, err := c.lb.getConfigMap()
+	if err != nil {
+		return err
+	}
+	if cm.Data, err = c.lb.configMapData(cfg); err != nil {
+		return err
+	}
+	return c.lb.updateConfigMap(cm, cfg)
+}
+
+func (c *configMapStateStore) String() string {
+	return "configmap:" + c.lb.namespace + "/" + c.lb.name
+}
+
+// secretConfigKey is the key in the data of a Secret that the config is
+// stored in.
+const secretConfigKey = "config.json"
+
+// secretStateStore stores the config in a Secret. A missing Secret is loaded
+// as an empty config, and created when it is saved.
+type secretStateStore struct {
+	kubeClient      kubernetes.Interface
+	namespace, name string
+}
+
+func (s *secretStateStore) load() (*config, error) {
+	secret, err := s.kubeClient.CoreV1().Secrets(s.namespace).Get(s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return &config{Version: currentConfigVersion}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting secret: %s", err.Error())
+	}
+
+	data, ok := secret.Data[secretConfigKey]
+	if !ok {
+		return &config{Version: currentConfigVersion}, nil
+	}
+	cfg, err := decodeConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding config in secret: %s", err.Error())
+	}
+	return cfg, nil
+}
+
+func (s *secretStateStore) save(cfg *config) error {
+	data, err := cfg.encode()
+	if err != nil {
+		return fmt.Errorf("error encoding config: %s", err.Error())
+	}
+
+	secret, err := s.kubeClient.CoreV1().Secrets(s.namespace).Get(s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		secret = &apiv1.Secret{}
+		secret.Namespace = s.namespace
+		secret.Name = s.name
+		secret.Data = map[string][]byte{secretConfigKey: data}
+		if _, err := s.kubeClient.CoreV1().Secrets(s.namespace).Create(secret); err != nil {
+			return fmt.Errorf("error creating secret: %s", err.Error())
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting secret: %s", err.Error())
+	}
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[secretConfigKey] = data
+	if _, err := s.kubeClient.CoreV1().Secrets(s.namespace).Update(secret); err != nil {
+		return fmt.Errorf("error updating secret: %s", err.Error())
+	}
+	return nil
+}
+
+func (s *secretStateStore) String() string {
+	return "secret:" + s.namespace + "/" + s.name
+}
+
+// fileStateStore stores the config as JSON in a file. A missing file is
+// loaded as an empty config.
+type fileStateStore string
+
+func (f fileStateStore) load() (*config, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return &config{Version: currentConfigVersion}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %s", err.Error())
+	}
+	cfg, err := decodeConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding config file: %s", err.Error())
+	}
+	return cfg, nil
+}
+
+func (f fileStateStore) save(cfg *config) error {
+	data, err := cfg.encode()
+	if err != nil {
+		return fmt.Errorf("error encoding config: %s", err.Error())
+	}
+
+	// write to a temporary file and rename it, so that the file is never
+	// left partially written
+	tmp, err := ioutil.TempFile(filepath.Dir(string(f)), filepath.Base(string(f)))
+	if err != nil {
+		return fmt.Errorf("error creating config file: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing config file: %s", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing config file: %s", err.Error())
+	}
+	if err := os.Rename(tmp.Name(), string(f)); err != nil {
+		return fmt.Errorf("error writing config file: %s", err.Error())
+	}
+	return nil
+}
+
+func (f fileStateStore) String() string {
+	return "file:" + string(f)
+}
+
+// migrateState copies the config from one store to another, and verifies
+// that every allocation was preserved. Unless force is set, it refuses to
+// overwrite a destination that already has allocations.
+func migrateState(from, to stateStore, force bool) (*config, error) {
+	cfg, err := from.load()
+	if err != nil {
+		return nil, fmt.Errorf("error loading config from %s: %s", from, err.Error())
+	}
+
+	existing, err := to.load()
+	if err != nil {
+		return nil, fmt.Errorf("error loading config from %s: %s", to, err.Error())
+	}
+	if len(existing.Services) > 0 && !force {
+		return nil, fmt.Errorf("%s already has %d allocations", to, len(existing.Services))
+	}
+
+	if err := to.save(cfg); err != nil {
+		return nil, fmt.Errorf("error saving config to %s: %s", to, err.Error())
+	}
+
+	migrated, err := to.load()
+	if err != nil {
+		return nil, fmt.Errorf("error loading migrated config from %s: %s", to, err.Error())
+	}
+	if err := sameAllocations(cfg, migrated); err != nil {
+		return nil, fmt.Errorf("migrated config in %s does not match: %s", to, err.Error())
+	}
+
+	return migrated, nil
+}
+
+// sameAllocations returns an error if a and b do not allocate the same IP to
+// every service UID, or reserve the same IPs.
+func sameAllocations(a, b *config) error {
+	ips := make(map[string]string, len(b.Services))
+	for _, s := range b.Services {
+		ips[s.UID] = s.IP
+	}
+	for _, s := range a.Services {
+		ip, ok := ips[s.UID]
+		if !ok {
+			return fmt.Errorf("service %s/%s (%s) is missing", s.ServiceNamespace, s.ServiceName, s.UID)
+		}
+		if ip != s.IP {
+			return fmt.Errorf("service %s/%s (%s) has ip %s instead of %s", s.ServiceNamespace, s.ServiceName, s.UID, ip, s.IP)
+		}
+		delete(ips, s.UID)
+	}
+	for uid := range ips {
+		return fmt.Errorf("unexpected service %s", uid)
+	}
+
+	reserved := make(map[string]bool, len(b.Reserved))
+	for _, ip := range b.Reserved {
+		reserved[ip] = true
+	}
+	for _, ip := range a.Reserved {
+		if !reserved[ip] {
+			return fmt.Errorf("reserved ip %s is missing", ip)
+		}
+	}
+	if len(a.Reserved) != len(b.Reserved) {
+		return fmt.Errorf("expected %d reserved ips but found %d", len(a.Reserved), len(b.Reserved))
+	}
+	return nil
+}
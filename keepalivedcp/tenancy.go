@@ -0,0 +1,104 @@
+package keepalivedcp
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// restricted returns true if only some namespaces can allocate VIPs from the
+// pool.
+func (p *pool) restricted() bool {
+	return len(p.Namespaces) > 0 || len(p.NamespaceSelector) > 0
+}
+
+// permits returns true if services in namespace, which has labels, can be
+// allocated VIPs from the pool. A namespace is permitted if it is listed in
+// the pool's namespaces, or matches its namespace selector.
+func (p *pool) permits(namespace string, labels map[string]string) bool {
+	if !p.restricted() {
+		return true
+	}
+	for _, ns := range p.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	if len(p.NamespaceSelector) == 0 {
+		return false
+	}
+	for k, v := range p.NamespaceSelector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// namespaceLabels returns the labels of namespace, if any pool selects
+// namespaces by their labels.
+func (k *KeepalivedLoadBalancer) namespaceLabels(namespace string) (map[string]string, error) {
+	needed := false
+	for _, p := range k.pools {
+		if len(p.NamespaceSelector) > 0 {
+			needed = true
+			break
+		}
+	}
+	if !needed {
+		return nil, nil
+	}
+
+	ns, err := k.kubeClient.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting namespace '%s': %s", namespace, err.Error())
+	}
+	return ns.Labels, nil
+}
+
+// checkPermitted returns an error if the pool named by sc, or containing
+// loadBalancerIP, does not permit sc's namespace. A loadBalancerIP outside
+// every pool is only permitted if every pool permits sc's namespace, so that
+// tenants cannot claim addresses no pool hands out.
+func (k *KeepalivedLoadBalancer) checkPermitted(sc serviceConfig, loadBalancerIP string) error {
+	var named, containing *pool
+	if sc.Pool != "" {
+		named, _ = k.poolByName(sc.Pool)
+	}
+	if loadBalancerIP != "" {
+		containing, _ = k.poolContaining(loadBalancerIP)
+	}
+	outside := loadBalancerIP != "" && containing == nil && k.restrictedPools()
+	if !outside && (named == nil || !named.restricted()) && (containing == nil || !containing.restricted()) {
+		return nil
+	}
+
+	labels, err := k.namespaceLabels(sc.ServiceNamespace)
+	if err != nil {
+		return err
+	}
+	if named != nil && !named.permits(sc.ServiceNamespace, labels) {
+		return fmt.Errorf("pool '%s' in annotation %s is not permitted in namespace '%s'", named.Name, servicePoolAnnotationKey, sc.ServiceNamespace)
+	}
+	if containing != nil && !containing.permits(sc.ServiceNamespace, labels) {
+		return fmt.Errorf("loadBalancerIP %s is in pool '%s', which is not permitted in namespace '%s'", loadBalancerIP, containing.Name, sc.ServiceNamespace)
+	}
+	if outside {
+		for i := range k.pools {
+			if p := &k.pools[i]; !p.permits(sc.ServiceNamespace, labels) {
+				return fmt.Errorf("loadBalancerIP %s is not in any pool, and pool '%s' is not permitted in namespace '%s'", loadBalancerIP, p.Name, sc.ServiceNamespace)
+			}
+		}
+	}
+	return nil
+}
+
+// restrictedPools returns true if any pool is restricted to some namespaces.
+func (k *KeepalivedLoadBalancer) restrictedPools() bool {
+	for i := range k.pools {
+		if k.pools[i].restricted() {
+			return true
+		}
+	}
+	return false
+}
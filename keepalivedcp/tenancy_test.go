@@ -0,0 +1,120 @@
+package keepalivedcp
+
+import (
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+func TestPoolPermits(t *testing.T) {
+	type testDef struct {
+		name      string
+		pool      pool
+		namespace string
+		labels    map[string]string
+		expected  bool
+	}
+
+	tests := []testDef{
+		{
+			name:      "unrestricted",
+			pool:      pool{Name: "shared"},
+			namespace: "tenant-a",
+			expected:  true,
+		},
+		{
+			name:      "listed namespace",
+			pool:      pool{Name: "a", Namespaces: []string{"tenant-a", "tenant-a-dev"}},
+			namespace: "tenant-a-dev",
+			expected:  true,
+		},
+		{
+			name:      "unlisted namespace",
+			pool:      pool{Name: "a", Namespaces: []string{"tenant-a"}},
+			namespace: "tenant-b",
+			expected:  false,
+		},
+		{
+			name:      "matching selector",
+			pool:      pool{Name: "a", NamespaceSelector: map[string]string{"tenant": "a"}},
+			namespace: "anything",
+			labels:    map[string]string{"tenant": "a", "env": "prod"},
+			expected:  true,
+		},
+		{
+			name:      "not matching selector",
+			pool:      pool{Name: "a", NamespaceSelector: map[string]string{"tenant": "a"}},
+			namespace: "anything",
+			labels:    map[string]string{"tenant": "b"},
+			expected:  false,
+		},
+		{
+			name:      "listed but not matching selector",
+			pool:      pool{Name: "a", Namespaces: []string{"tenant-a"}, NamespaceSelector: map[string]string{"tenant": "a"}},
+			namespace: "tenant-a",
+			expected:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				if permits := test.pool.permits(test.namespace, test.labels); permits != test.expected {
+					t.Errorf("expected permits to be %t but got %t", test.expected, permits)
+				}
+			}
+		}(test))
+	}
+}
+
+func TestTenantPools(t *testing.T) {
+	k := NewKeepalivedLoadBalancer(nil, nil, "", "", "", "", "")
+	k.pools = []pool{
+		{Name: "tenant-a", CIDR: "10.0.0.0/24", Namespaces: []string{"tenant-a"}},
+		{Name: "tenant-b", CIDR: "10.0.1.0/24", Namespaces: []string{"tenant-b"}},
+	}
+	nodes := []*v1.Node{{}}
+
+	candidates, err := k.candidatePools(serviceConfig{ServiceNamespace: "tenant-b"}, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(candidates) != 1 || candidates[0].Name != "tenant-b" {
+		t.Errorf("expected only pool tenant-b but got %v", candidates)
+	}
+
+	if _, err := k.candidatePools(serviceConfig{ServiceNamespace: "tenant-c"}, nodes); err == nil {
+		t.Errorf("expected error for namespace without a permitted pool")
+	}
+
+	if err := k.checkPermitted(serviceConfig{ServiceNamespace: "tenant-b", Pool: "tenant-a"}, ""); err == nil {
+		t.Errorf("expected error for another tenant's pool annotation")
+	}
+	if err := k.checkPermitted(serviceConfig{ServiceNamespace: "tenant-b"}, "10.0.0.10"); err == nil {
+		t.Errorf("expected error for a loadBalancerIP in another tenant's pool")
+	}
+	if err := k.checkPermitted(serviceConfig{ServiceNamespace: "tenant-b"}, "10.0.1.10"); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if err := k.checkPermitted(serviceConfig{ServiceNamespace: "tenant-b"}, "192.168.0.10"); err == nil {
+		t.Errorf("expected error for a loadBalancerIP outside every pool")
+	}
+
+	// a namespace every pool permits can use a loadBalancerIP outside them
+	k.pools = []pool{
+		{Name: "shared", CIDR: "10.0.0.0/24"},
+		{Name: "tenant-a", CIDR: "10.0.1.0/24", Namespaces: []string{"tenant-a"}},
+	}
+	if err := k.checkPermitted(serviceConfig{ServiceNamespace: "tenant-a"}, "192.168.0.10"); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if err := k.checkPermitted(serviceConfig{ServiceNamespace: "tenant-b"}, "192.168.0.10"); err == nil {
+		t.Errorf("expected error for a loadBalancerIP outside every pool in a restricted namespace")
+	}
+
+	// without restricted pools, any namespace can
+	k.pools = []pool{{Name: "shared", CIDR: "10.0.0.0/24"}}
+	if err := k.checkPermitted(serviceConfig{ServiceNamespace: "tenant-b"}, "192.168.0.10"); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+}
@@ -0,0 +1,202 @@
+package keepalivedcp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+// topology determines which zone nodes are in.
+type topology interface {
+	// nodeZone returns the zone that node is in, and false if it is unknown.
+	nodeZone(node *v1.Node) (cloudprovider.Zone, bool)
+}
+
+// newTopology returns the topology described by source, which is one of:
+//
+//	file:<path>  a YAML or JSON file mapping node name patterns and subnets to zones
+//	labels       the failure-domain.beta.kubernetes.io/zone and region labels on nodes
+func newTopology(source string) (topology, error) {
+	switch {
+	case strings.HasPrefix(source, "file:"):
+		return loadTopologyFile(strings.TrimPrefix(source, "file:"))
+	case source == "labels":
+		return labelTopology{}, nil
+	}
+	return nil, fmt.Errorf("invalid topology source '%s': must be one of file:<path> or labels", source)
+}
+
+// topologyZone maps nodes to a zone by their name or address.
+type topologyZone struct {
+	// Name is the failure domain of the zone, eg. a rack
+	Name string `json:"name"`
+	// Region is the region of the zone, eg. a room or site
+	Region string `json:"region"`
+	// Nodes are patterns, as used by path.Match, matching the names of
+	// nodes in the zone
+	Nodes []string `json:"nodes,omitempty"`
+	// Subnets are CIDRs containing the addresses of nodes in the zone
+	Subnets []string `json:"subnets,omitempty"`
+
+	subnets []*net.IPNet
+}
+
+// fileTopology is a list of zones, of which the first matching a node is
+// the node's zone.
+type fileTopology struct {
+	Zones []topologyZone `json:"zones"`
+}
+
+func loadTopologyFile(filename string) (*fileTopology, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading topology file: %s", err.Error())
+	}
+	return parseTopology(data)
+}
+
+func parseTopology(data []byte) (*fileTopology, error) {
+	t := fileTopology{}
+	if err := yaml.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("error parsing topology: %s", err.Error())
+	}
+
+	for i := range t.Zones {
+		z := &t.Zones[i]
+		if z.Name == "" {
+			return nil, fmt.Errorf("zone %d in topology has no name", i)
+		}
+		for _, p := range z.Nodes {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("invalid node pattern '%s' in zone '%s': %s", p, z.Name, err.Error())
+			}
+		}
+		for _, s := range z.Subnets {
+			_, ipnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid subnet '%s' in zone '%s': %s", s, z.Name, err.Error())
+			}
+			z.subnets = append(z.subnets, ipnet)
+		}
+	}
+
+	return &t, nil
+}
+
+func (t *fileTopology) nodeZone(node *v1.Node) (cloudprovider.Zone, bool) {
+	for _, z := range t.Zones {
+		if z.matches(node) {
+			return cloudprovider.Zone{FailureDomain: z.Name, Region: z.Region}, true
+		}
+	}
+	return cloudprovider.Zone{}, false
+}
+
+func (z *topologyZone) matches(node *v1.Node) bool {
+	for _, p := range z.Nodes {
+		if ok, _ := path.Match(p, node.Name); ok {
+			return true
+		}
+	}
+	for _, a := range node.Status.Addresses {
+		ip := net.ParseIP(a.Address)
+		if ip == nil {
+			continue
+		}
+		for _, s := range z.subnets {
+			if s.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// labelTopology reads the zone of a node from its well known labels.
+type labelTopology struct{}
+
+func (labelTopology) nodeZone(node *v1.Node) (cloudprovider.Zone, bool) {
+	zone, ok := node.Labels[metav1.LabelZoneFailureDomain]
+	if !ok {
+		return cloudprovider.Zone{}, false
+	}
+	return cloudprovider.Zone{FailureDomain: zone, Region: node.Labels[metav1.LabelZoneRegion]}, true
+}
+
+// zones implements cloudprovider.Zones by looking up the zone of the local
+// node in a topology.
+type zones struct {
+	topology   topology
+	kubeClient kubernetes.Interface
+	nodeName   string
+}
+
+var _ cloudprovider.Zones = &zones{}
+
+// GetZone returns the zone of the local node. The service controller fails
+// to start if it returns an error, so an empty zone is returned instead if
+// the local node or its zone is unknown.
+func (z *zones) GetZone() (cloudprovider.Zone, error) {
+	if z.topology == nil {
+		return cloudprovider.Zone{FailureDomain: "FailureDomain1", Region: "Region1"}, nil
+	}
+
+	if z.nodeName == "" {
+		glog.Warningf("not reporting a zone: KEEPALIVED_NODE_NAME is not set")
+		return cloudprovider.Zone{}, nil
+	}
+
+	node, err := z.localNode()
+	if err != nil {
+		glog.Warningf("not reporting a zone: %s", err.Error())
+		return cloudprovider.Zone{}, nil
+	}
+
+	zone, ok := z.topology.nodeZone(node)
+	if !ok {
+		glog.Warningf("not reporting a zone: node '%s' is not in any zone", node.Name)
+		return cloudprovider.Zone{}, nil
+	}
+	return zone, nil
+}
+
+// localNode returns the Node for the machine we are running on. Label based
+// topologies need the Node from the API server, otherwise it is built from
+// the node name and local interface addresses.
+func (z *zones) localNode() (*v1.Node, error) {
+	name := z.nodeName
+
+	if _, ok := z.topology.(labelTopology); ok {
+		n, err := z.kubeClient.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error getting node '%s': %s", name, err.Error())
+		}
+		node := &v1.Node{}
+		node.Name = n.Name
+		node.Labels = n.Labels
+		return node, nil
+	}
+
+	node := &v1.Node{}
+	node.Name = name
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("error getting interface addresses: %s", err.Error())
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			node.Status.Addresses = append(node.Status.Addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: ipnet.IP.String()})
+		}
+	}
+	return node, nil
+}
@@ -0,0 +1,83 @@
+package keepalivedcp
+
+import (
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+const testTopology = `
+zones:
+- name: rack-1
+  region: room-a
+  nodes: ["r1-*"]
+- name: rack-2
+  region: room-a
+  subnets: ["10.0.2.0/24"]
+`
+
+func TestFileTopologyNodeZone(t *testing.T) {
+	topo, err := parseTopology([]byte(testTopology))
+	if err != nil {
+		t.Fatalf("got error: %s", err.Error())
+	}
+
+	type testDef struct {
+		name     string
+		node     string
+		address  string
+		expected cloudprovider.Zone
+		found    bool
+	}
+
+	tests := []testDef{
+		{name: "match by name", node: "r1-node-1", expected: cloudprovider.Zone{FailureDomain: "rack-1", Region: "room-a"}, found: true},
+		{name: "match by subnet", node: "node-7", address: "10.0.2.7", expected: cloudprovider.Zone{FailureDomain: "rack-2", Region: "room-a"}, found: true},
+		{name: "no match", node: "node-8", address: "10.0.3.8"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				node := &v1.Node{}
+				node.Name = test.node
+				if test.address != "" {
+					node.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: test.address}}
+				}
+
+				zone, found := topo.nodeZone(node)
+				if found != test.found {
+					t.Errorf("expected found to be %t but got %t", test.found, found)
+				}
+				if zone != test.expected {
+					t.Errorf("expected zone %v but got %v", test.expected, zone)
+				}
+			}
+		}(test))
+	}
+}
+
+func TestParseTopologyInvalidSubnet(t *testing.T) {
+	if _, err := parseTopology([]byte("zones: [{name: rack-1, subnets: [10.0.0.0]}]")); err == nil {
+		t.Errorf("expected error but got none")
+	}
+}
+
+func TestGetZoneUnknownNode(t *testing.T) {
+	topo, err := parseTopology([]byte("zones: [{name: rack-1, nodes: [node-1]}]"))
+	if err != nil {
+		t.Fatalf("error parsing topology: %s", err.Error())
+	}
+
+	for _, nodeName := range []string{"", "node-2"} {
+		z := &zones{topology: topo, nodeName: nodeName}
+		zone, err := z.GetZone()
+		if err != nil {
+			t.Errorf("expected no error for node '%s' but got: %s", nodeName, err.Error())
+		}
+		if zone != (cloudprovider.Zone{}) {
+			t.Errorf("expected empty zone for node '%s' but got %v", nodeName, zone)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package keepalivedcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/golang/glog"
+
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+// admissionReview is the subset of an admission.k8s.io/v1beta1
+// AdmissionReview used by the webhook. The admission API is not vendored, so
+// it is decoded by hand.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion,omitempty"`
+	Kind       string             `json:"kind,omitempty"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       string          `json:"uid"`
+	Operation string          `json:"operation"`
+	Namespace string          `json:"namespace"`
+	Object    json.RawMessage `json:"object"`
+}
+
+type admissionResponse struct {
+	UID     string           `json:"uid"`
+	Allowed bool             `json:"allowed"`
+	Result  *admissionStatus `json:"status,omitempty"`
+}
+
+type admissionStatus struct {
+	Message string `json:"message,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Code    int32  `json:"code,omitempty"`
+}
+
+// serviceWebhook is a validating admission webhook that rejects LoadBalancer
+// services that the load balancer would fail to configure or allocate a VIP
+// to.
+type serviceWebhook struct {
+	lb *KeepalivedLoadBalancer
+	// loadConfig returns the current config
+	loadConfig func() (*config, error)
+}
+
+func newServiceWebhook(lb *KeepalivedLoadBalancer) *serviceWebhook {
+	return &serviceWebhook{
+		lb: lb,
+		loadConfig: func() (*config, error) {
+			cm, err := lb.getConfigMap()
+			if err != nil {
+				return nil, err
+			}
+			return configFrom(cm)
+		},
+	}
+}
+
+func (w *serviceWebhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	review := admissionReview{}
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+		http.Error(rw, fmt.Sprintf("error decoding admission review: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(rw, "admission review has no request", http.StatusBadRequest)
+		return
+	}
+
+	resp := &admissionResponse{UID: review.Request.UID, Allowed: true}
+	if err := w.review(review.Request); err != nil {
+		glog.V(2).Infof("rejecting service in admission request %s: %s", review.Request.UID, err.Error())
+		resp.Allowed = false
+		resp.Result = &admissionStatus{Message: err.Error(), Reason: "Invalid", Code: http.StatusUnprocessableEntity}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(admissionReview{
+		APIVersion: review.APIVersion,
+		Kind:       review.Kind,
+		Response:   resp,
+	})
+}
+
+func (w *serviceWebhook) review(req *admissionRequest) error {
+	if req.Operation != "CREATE" && req.Operation != "UPDATE" {
+		return nil
+	}
+
+	service := &v1.Service{}
+	if err := json.Unmarshal(req.Object, service); err != nil {
+		return fmt.Errorf("error decoding service: %s", err.Error())
+	}
+	if service.Namespace == "" {
+		service.Namespace = req.Namespace
+	}
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return nil
+	}
+
+	cfg, err := w.loadConfig()
+	if err != nil {
+		// the load balancer cannot configure the service either, but it
+		// may recover before the service is synced, so do not block it
+		glog.Errorf("admitting service '%s/%s' without validation: %s", service.Namespace, service.Name, err.Error())
+		return nil
+	}
+	return w.lb.validateService(cfg, service)
+}
+
+// validateService returns an error if service would be refused by
+// syncLoadBalancer, or could not be allocated a VIP from cfg. The service may
+// not have been created, and so may not have a UID.
+func (k *KeepalivedLoadBalancer) validateService(cfg *config, service *v1.Service) error {
+	sc, err := k.serviceConfigFor(service)
+	if err != nil {
+		return err
+	}
+
+	lbip := service.Spec.LoadBalancerIP
+	if lbip != "" && net.ParseIP(lbip) == nil {
+		return fmt.Errorf("invalid loadBalancerIP specified '%s'", lbip)
+	}
+
+	if err := k.checkPermitted(sc, lbip); err != nil {
+		return err
+	}
+
+	var existing *serviceConfig
+	for i, s := range cfg.Services {
+		if (sc.UID != "" && s.UID == sc.UID) || (s.ServiceNamespace == sc.ServiceNamespace && s.ServiceName == sc.ServiceName) {
+			existing = &cfg.Services[i]
+			sc.UID = s.UID
+			break
+		}
+	}
+
+	if err := checkHostname(cfg, sc); err != nil {
+		return err
+	}
+
+	// the ports and SNI hostnames of the service must not clash with those
+	// of the other services on the VIP it requests or already has
+	shared := sc
+	shared.IP = lbip
+	if shared.IP == "" && existing != nil {
+		shared.IP = existing.IP
+	}
+	if shared.IP != "" {
+		if err := k.checkSharing(cfg, shared); err != nil {
+			return err
+		}
+	}
+
+	if lbip != "" {
+		if existing != nil && existing.IP == lbip {
+			return nil
+		}
+		if cfg.isReserved(lbip) {
+			return fmt.Errorf("loadBalancerIP %s is reserved", lbip)
+		}
+		var pools []*pool
+		if p, ok := k.poolContaining(lbip); ok {
+			pools = []*pool{p}
+		}
+		_, err := k.withinQuota(cfg, sc, pools)
+		return err
+	}
+
+	if existing != nil && (sc.Pool == "" || sc.Pool == existing.Pool) {
+		return nil
+	}
+
+	// nodes are not known here, so pools are only checked for their
+	// namespace and quota, and for free addresses
+	candidates, err := k.permittedPools(sc)
+	if err != nil {
+		return err
+	}
+	if candidates, err = k.withinQuota(cfg, sc, candidates); err != nil {
+		return err
+	}
+	for _, p := range candidates {
+		if _, err := cfg.allocateIP(p.CIDR); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no vip is free in any of the %d candidate pools", len(candidates))
+}
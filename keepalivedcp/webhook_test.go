@@ -0,0 +1,152 @@
+package keepalivedcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api/v1"
+)
+
+func TestServiceWebhook(t *testing.T) {
+	type testDef struct {
+		name        string
+		operation   string
+		service     v1.Service
+		expectAllow bool
+	}
+
+	loadBalancer := func(namespace, name string, annotations map[string]string, lbip string) v1.Service {
+		svc := v1.Service{}
+		svc.Namespace = namespace
+		svc.Name = name
+		svc.Annotations = annotations
+		svc.Spec.Type = v1.ServiceTypeLoadBalancer
+		svc.Spec.LoadBalancerIP = lbip
+		return svc
+	}
+
+	k := NewKeepalivedLoadBalancer(nil, nil, "", "", "", "", "")
+	k.pools = []pool{
+		{Name: "tenant-a", CIDR: "10.0.0.0/30", Namespaces: []string{"tenant-a"}},
+		{Name: "tenant-b", CIDR: "10.0.1.0/24", Namespaces: []string{"tenant-b"}},
+	}
+	k.quotas = []quota{{Namespace: "tenant-b", VIPs: intPtr(1)}}
+
+	cfg := &config{
+		Services: []serviceConfig{
+			{UID: "1", IP: "10.0.0.1", ServiceNamespace: "tenant-a", ServiceName: "a1", Pool: "tenant-a"},
+			{UID: "2", IP: "10.0.0.2", ServiceNamespace: "tenant-a", ServiceName: "a2", Pool: "tenant-a"},
+			{UID: "3", IP: "10.0.1.1", ServiceNamespace: "tenant-b", ServiceName: "b1", Pool: "tenant-b"},
+		},
+	}
+
+	w := &serviceWebhook{lb: k, loadConfig: func() (*config, error) { return cfg, nil }}
+	server := httptest.NewServer(w)
+	defer server.Close()
+
+	tests := []testDef{
+		{
+			name:        "not a load balancer",
+			operation:   "CREATE",
+			service:     v1.Service{ObjectMeta: loadBalancer("tenant-a", "x", nil, "").ObjectMeta},
+			expectAllow: true,
+		},
+		{
+			name:        "invalid forward method annotation",
+			operation:   "CREATE",
+			service:     loadBalancer("tenant-b", "x", map[string]string{serviceForwardMethodAnnotationKey: "TUNNEL"}, ""),
+			expectAllow: false,
+		},
+		{
+			name:        "invalid scheduler annotation",
+			operation:   "CREATE",
+			service:     loadBalancer("tenant-b", "x", map[string]string{serviceSchedulerAnnotationKey: "bogus"}, ""),
+			expectAllow: false,
+		},
+		{
+			name:        "loadBalancerIP in another tenant's pool",
+			operation:   "CREATE",
+			service:     loadBalancer("tenant-a", "x", nil, "10.0.1.10"),
+			expectAllow: false,
+		},
+		{
+			name:        "loadBalancerIP allocated to another service",
+			operation:   "CREATE",
+			service:     loadBalancer("tenant-a", "x", nil, "10.0.0.1"),
+			expectAllow: false,
+		},
+		{
+			name:        "existing service keeping its loadBalancerIP",
+			operation:   "UPDATE",
+			service:     loadBalancer("tenant-a", "a1", nil, "10.0.0.1"),
+			expectAllow: true,
+		},
+		{
+			name:        "pool exhausted",
+			operation:   "CREATE",
+			service:     loadBalancer("tenant-a", "x", nil, ""),
+			expectAllow: false,
+		},
+		{
+			name:        "quota exceeded",
+			operation:   "CREATE",
+			service:     loadBalancer("tenant-b", "x", nil, ""),
+			expectAllow: false,
+		},
+		{
+			name:        "existing service within quota",
+			operation:   "UPDATE",
+			service:     loadBalancer("tenant-b", "b1", nil, ""),
+			expectAllow: true,
+		},
+		{
+			name:        "delete is always allowed",
+			operation:   "DELETE",
+			service:     loadBalancer("tenant-b", "x", nil, ""),
+			expectAllow: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(test testDef) func(*testing.T) {
+			return func(t *testing.T) {
+				obj, err := json.Marshal(test.service)
+				if err != nil {
+					t.Fatalf("error encoding service: %s", err.Error())
+				}
+				body, err := json.Marshal(admissionReview{
+					APIVersion: "admission.k8s.io/v1beta1",
+					Kind:       "AdmissionReview",
+					Request:    &admissionRequest{UID: "req", Operation: test.operation, Namespace: test.service.Namespace, Object: obj},
+				})
+				if err != nil {
+					t.Fatalf("error encoding admission review: %s", err.Error())
+				}
+
+				resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+				if err != nil {
+					t.Fatalf("error posting admission review: %s", err.Error())
+				}
+				defer resp.Body.Close()
+
+				review := admissionReview{}
+				if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+					t.Fatalf("error decoding admission review: %s", err.Error())
+				}
+				if review.Response == nil || review.Response.UID != "req" {
+					t.Fatalf("unexpected response: %+v", review.Response)
+				}
+				if review.Response.Allowed != test.expectAllow {
+					msg := ""
+					if review.Response.Result != nil {
+						msg = review.Response.Result.Message
+					}
+					t.Errorf("expected allowed to be %t but got %t (%s)", test.expectAllow, review.Response.Allowed, msg)
+				}
+			}
+		}(test))
+	}
+}
@@ -27,6 +27,14 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		if err := keepalivedcp.RunCtl(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	s := options.NewCloudControllerManagerServer()
 	s.AddFlags(pflag.CommandLine)
 	addVersionFlag()